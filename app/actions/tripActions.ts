@@ -12,7 +12,8 @@ import {
     rateDriverByRider,
     rateRiderByDriver,
     removeRiderFromTrip,
-    getAllUpcomingTrips
+    getAllUpcomingTrips,
+    PricingMode
 } from "@/db/db";
 import { TripViewData } from "@/store/types";
 import { splitRouteGeometry } from "@/utils/tripParsers";
@@ -28,6 +29,7 @@ export async function createTripAction(data: {
     fare_per_seat: number;
     total_seats: number;
     description?: string;
+    pricing_mode?: PricingMode;
     stops?: { location: { lat: number; lng: number }; address: string }[];
     route?: [number, number][];
 }) {
@@ -57,6 +59,7 @@ export async function createTripAction(data: {
         fare_per_seat: Number(data.fare_per_seat),
         total_seats: Number(data.total_seats),
         description: data.description,
+        pricing_mode: data.pricing_mode === 'distance' ? 'distance' : 'fixed',
         stops: data.stops?.map((stop, index) => ({
             location: `POINT(${stop.location.lng} ${stop.location.lat})`,
             address: stop.address,
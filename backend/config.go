@@ -0,0 +1,261 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// liveConfig holds the tunables of the realtime pipeline. Every field can be
+// overridden from the environment; unset or malformed values fall back to
+// the defaults below.
+type liveConfig struct {
+	LocationFlushInterval    time.Duration
+	LocationMaxSilence       time.Duration
+	LocationMinDisplacementM float64
+	LocationWriteInterval    time.Duration
+
+	GPSAccuracyM    float64
+	GPSMaxSpeedKmph float64
+
+	GeofenceApproachM   float64
+	GeofenceArriveM     float64
+	GeofenceHysteresisM float64
+
+	RouteDeviationM       float64
+	RouteRejoinM          float64
+	RouteDeviationSustain time.Duration
+	RouteReversalM        float64
+
+	TraceSimplifyM float64
+
+	DriverSignalTimeout    time.Duration
+	SignalWatchdogInterval time.Duration
+
+	WSEventLimits     map[string]rateLimit
+	WSUserLimit       rateLimit
+	WSMaxViolations   int
+	WSViolationWindow time.Duration
+
+	ShutdownGrace time.Duration
+
+	AuthCacheTTL time.Duration
+
+	ChatRetention time.Duration
+
+	SOSEscalateAfter  time.Duration
+	SOSMaxEscalations int
+
+	// ReplayStaffToken lets operations staff replay any completed trip by
+	// sending it as staffToken in replay_trip. It is a credential of its
+	// own, not shared with any other endpoint; staff replay is off while it
+	// is empty.
+	ReplayStaffToken string
+
+	FareMinRatio float64
+	FareMaxRatio float64
+	FareRoundTo  float64
+}
+
+var cfg = defaultLiveConfig()
+
+func defaultLiveConfig() liveConfig {
+	return liveConfig{
+		LocationFlushInterval:    time.Second,
+		LocationMaxSilence:       10 * time.Second,
+		LocationMinDisplacementM: 5,
+		LocationWriteInterval:    2 * time.Second,
+
+		GPSAccuracyM:    15,
+		GPSMaxSpeedKmph: 160,
+
+		GeofenceApproachM:   500,
+		GeofenceArriveM:     50,
+		GeofenceHysteresisM: 30,
+
+		RouteDeviationM:       150,
+		RouteRejoinM:          75,
+		RouteDeviationSustain: 30 * time.Second,
+		RouteReversalM:        200,
+
+		TraceSimplifyM: 5,
+
+		DriverSignalTimeout:    45 * time.Second,
+		SignalWatchdogInterval: 5 * time.Second,
+
+		WSEventLimits: map[string]rateLimit{
+			"location_update": {Rate: 5, Burst: 10},
+			"join_trip":       {Rate: 1, Burst: 10},
+			"subscribe":       {Rate: 1, Burst: 10},
+			"unsubscribe":     {Rate: 1, Burst: 10},
+			"resume":          {Rate: 1, Burst: 10},
+			"rider_action":    {Rate: 1, Burst: 5},
+			"trip_action":     {Rate: 1, Burst: 5},
+			"chat_message":    {Rate: 1, Burst: 5},
+			"sos":             {Rate: 1, Burst: 5},
+			"replay_trip":     {Rate: 1, Burst: 5},
+			"replay_control":  {Rate: 2, Burst: 10},
+			rateKeyOther:      {Rate: 1, Burst: 5},
+		},
+		WSUserLimit:       rateLimit{Rate: 20, Burst: 40},
+		WSMaxViolations:   20,
+		WSViolationWindow: 10 * time.Second,
+
+		ShutdownGrace: 15 * time.Second,
+
+		AuthCacheTTL: 30 * time.Second,
+
+		ChatRetention: 30 * 24 * time.Hour,
+
+		SOSEscalateAfter:  2 * time.Minute,
+		SOSMaxEscalations: 5,
+
+		FareMinRatio: 0.5,
+		FareMaxRatio: 1,
+		FareRoundTo:  5,
+	}
+}
+
+func loadLiveConfig() liveConfig {
+	c := defaultLiveConfig()
+	c.LocationFlushInterval = envDuration("LOCATION_FLUSH_INTERVAL", c.LocationFlushInterval)
+	c.LocationMaxSilence = envDuration("LOCATION_MAX_SILENCE", c.LocationMaxSilence)
+	c.LocationMinDisplacementM = envFloat("LOCATION_MIN_DISPLACEMENT_M", c.LocationMinDisplacementM)
+	c.LocationWriteInterval = envInterval("LOCATION_WRITE_INTERVAL", c.LocationWriteInterval)
+	c.GPSAccuracyM = envFloat("GPS_ACCURACY_M", c.GPSAccuracyM)
+	c.GPSMaxSpeedKmph = envFloat("GPS_MAX_SPEED_KMPH", c.GPSMaxSpeedKmph)
+	c.GeofenceApproachM = envFloat("GEOFENCE_APPROACH_RADIUS_M", c.GeofenceApproachM)
+	c.GeofenceArriveM = envFloat("GEOFENCE_ARRIVE_RADIUS_M", c.GeofenceArriveM)
+	c.GeofenceHysteresisM = envFloat("GEOFENCE_HYSTERESIS_M", c.GeofenceHysteresisM)
+	c.RouteDeviationM = envFloat("ROUTE_DEVIATION_M", c.RouteDeviationM)
+	c.RouteRejoinM = envFloat("ROUTE_REJOIN_M", c.RouteRejoinM)
+	c.RouteDeviationSustain = envDuration("ROUTE_DEVIATION_SUSTAIN", c.RouteDeviationSustain)
+	c.RouteReversalM = envFloat("ROUTE_REVERSAL_M", c.RouteReversalM)
+	c.TraceSimplifyM = envFloat("TRACE_SIMPLIFY_M", c.TraceSimplifyM)
+	c.DriverSignalTimeout = envDuration("DRIVER_SIGNAL_TIMEOUT", c.DriverSignalTimeout)
+	c.SignalWatchdogInterval = envInterval("SIGNAL_WATCHDOG_INTERVAL", c.SignalWatchdogInterval)
+	c.WSEventLimits = envRateLimits("WS_EVENT_RATE_LIMITS", c.WSEventLimits)
+	c.WSUserLimit = envRateLimit("WS_USER_RATE_LIMIT", c.WSUserLimit)
+	c.WSMaxViolations = envInt("WS_MAX_RATE_VIOLATIONS", c.WSMaxViolations)
+	c.WSViolationWindow = envDuration("WS_RATE_VIOLATION_WINDOW", c.WSViolationWindow)
+	c.ShutdownGrace = envDuration("SHUTDOWN_GRACE", c.ShutdownGrace)
+	c.AuthCacheTTL = envDuration("WS_AUTH_CACHE_TTL", c.AuthCacheTTL)
+	c.ChatRetention = envDuration("CHAT_RETENTION", c.ChatRetention)
+	c.SOSEscalateAfter = envDuration("SOS_ESCALATE_AFTER", c.SOSEscalateAfter)
+	c.SOSMaxEscalations = envInt("SOS_MAX_ESCALATIONS", c.SOSMaxEscalations)
+	c.ReplayStaffToken = strings.TrimSpace(os.Getenv("REPLAY_STAFF_TOKEN"))
+	c.FareMinRatio = envFloat("FARE_MIN_RATIO", c.FareMinRatio)
+	c.FareMaxRatio = envFloat("FARE_MAX_RATIO", c.FareMaxRatio)
+	if c.FareMinRatio > c.FareMaxRatio {
+		d := defaultLiveConfig()
+		log.Printf("ignoring FARE_MIN_RATIO=%v above FARE_MAX_RATIO=%v", c.FareMinRatio, c.FareMaxRatio)
+		c.FareMinRatio, c.FareMaxRatio = d.FareMinRatio, d.FareMaxRatio
+	}
+	c.FareRoundTo = envFloat("FARE_ROUND_TO", c.FareRoundTo)
+	return c
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		log.Printf("ignoring invalid %s=%q", name, raw)
+		return fallback
+	}
+	return d
+}
+
+// envInterval is envDuration for ticker periods, which must be positive.
+func envInterval(name string, fallback time.Duration) time.Duration {
+	d := envDuration(name, fallback)
+	if d <= 0 {
+		log.Printf("ignoring invalid %s=%q", name, os.Getenv(name))
+		return fallback
+	}
+	return d
+}
+
+func envFloat(name string, fallback float64) float64 {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil || f < 0 {
+		log.Printf("ignoring invalid %s=%q", name, raw)
+		return fallback
+	}
+	return f
+}
+
+func envInt(name string, fallback int) int {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		log.Printf("ignoring invalid %s=%q", name, raw)
+		return fallback
+	}
+	return n
+}
+
+// envRateLimit parses "rate:burst", e.g. "20:40".
+func envRateLimit(name string, fallback rateLimit) rateLimit {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return fallback
+	}
+	l, ok := parseRateLimit(raw)
+	if !ok {
+		log.Printf("ignoring invalid %s=%q", name, raw)
+		return fallback
+	}
+	return l
+}
+
+// envRateLimits parses a comma-separated list of event=rate:burst pairs and
+// overlays them on the defaults, e.g. "location_update=2:4,rider_action=1:2".
+func envRateLimits(name string, defaults map[string]rateLimit) map[string]rateLimit {
+	limits := make(map[string]rateLimit, len(defaults))
+	for event, l := range defaults {
+		limits[event] = l
+	}
+
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return limits
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		event, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		l, ok := parseRateLimit(value)
+		if !found || event == "" || !ok {
+			log.Printf("ignoring invalid %s entry %q", name, pair)
+			continue
+		}
+		limits[event] = l
+	}
+	return limits
+}
+
+func parseRateLimit(raw string) (rateLimit, bool) {
+	rateRaw, burstRaw, found := strings.Cut(raw, ":")
+	if !found {
+		return rateLimit{}, false
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSpace(rateRaw), 64)
+	if err != nil || rate <= 0 {
+		return rateLimit{}, false
+	}
+	burst, err := strconv.ParseFloat(strings.TrimSpace(burstRaw), 64)
+	if err != nil || burst < 1 {
+		return rateLimit{}, false
+	}
+	return rateLimit{Rate: rate, Burst: burst}, true
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// insertTripMessage stores a chat message from a current participant of an
+// ongoing trip. Group messages have no recipient; a direct message goes
+// between the driver and one rider, and a rider's direct message always
+// goes to the driver. pgx.ErrNoRows means the trip is no longer ongoing or
+// the sender or recipient is not on it.
+func insertTripMessage(ctx context.Context, tripID, senderID, scope, recipientID, body string) (ChatMessagePayload, error) {
+	sql := `
+		WITH trip AS (
+			SELECT t.id, d.user_id AS driver_user_id
+			FROM trips t
+			JOIN drivers d ON d.id = t.driver_id
+			WHERE t.id = $1 AND t.status = 'ongoing'
+		), members AS (
+			SELECT driver_user_id AS user_id FROM trip
+			UNION ALL
+			SELECT rr.rider_id
+			FROM ride_requests rr
+			JOIN trip ON rr.trip_id = trip.id
+			WHERE rr.status IN ('waiting', 'onboard', 'dropedoff')
+		), target AS (
+			SELECT CASE
+				WHEN $3 = 'group' THEN NULL
+				WHEN $4 <> '' THEN $4::uuid
+				ELSE (SELECT driver_user_id FROM trip)
+			END AS recipient_id
+		)
+		INSERT INTO trip_messages (trip_id, sender_id, recipient_id, body)
+		SELECT $1, $2, target.recipient_id, $5
+		FROM target
+		WHERE EXISTS (SELECT 1 FROM members WHERE user_id = $2)
+		  AND (
+			($3 = 'group' AND target.recipient_id IS NULL)
+			OR (
+				target.recipient_id <> $2
+				AND EXISTS (SELECT 1 FROM members WHERE user_id = target.recipient_id)
+				AND EXISTS (SELECT 1 FROM trip WHERE driver_user_id IN ($2, target.recipient_id))
+			)
+		  )
+		RETURNING id, COALESCE(recipient_id::text, ''), created_at
+	`
+	m := ChatMessagePayload{TripID: tripID, SenderID: senderID, Scope: scope, Body: body}
+	var sentAt time.Time
+	if err := dbPool.QueryRow(ctx, sql, tripID, senderID, scope, recipientID, body).Scan(&m.MessageID, &m.RecipientID, &sentAt); err != nil {
+		return ChatMessagePayload{}, err
+	}
+	m.SentAt = sentAt.UTC().Format(time.RFC3339Nano)
+	return m, nil
+}
+
+// getTripMessages returns up to limit messages visible to userID, newest
+// first, older than the message with ID before when it is set.
+func getTripMessages(ctx context.Context, tripID, userID, before string, limit int) ([]ChatMessagePayload, error) {
+	sql := `
+		SELECT
+			m.id, m.sender_id, u.name,
+			CASE WHEN m.sender_id = d.user_id THEN 'driver' ELSE 'rider' END,
+			CASE WHEN m.recipient_id IS NULL THEN 'group' ELSE 'direct' END,
+			COALESCE(m.recipient_id::text, ''), m.body, m.created_at
+		FROM trip_messages m
+		JOIN trips t ON t.id = m.trip_id
+		JOIN drivers d ON d.id = t.driver_id
+		JOIN users u ON u.id = m.sender_id
+		WHERE m.trip_id = $1
+		  AND (m.recipient_id IS NULL OR m.sender_id = $2 OR m.recipient_id = $2)
+		  AND ($3 = '' OR (m.created_at, m.id) < (
+				SELECT created_at, id FROM trip_messages WHERE id::text = $3 AND trip_id = $1
+		  ))
+		ORDER BY m.created_at DESC, m.id DESC
+		LIMIT $4
+	`
+	rows, err := dbPool.Query(ctx, sql, tripID, userID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []ChatMessagePayload{}
+	for rows.Next() {
+		m := ChatMessagePayload{TripID: tripID}
+		var sentAt time.Time
+		if err := rows.Scan(&m.MessageID, &m.SenderID, &m.SenderName, &m.SenderRole, &m.Scope, &m.RecipientID, &m.Body, &sentAt); err != nil {
+			return nil, err
+		}
+		m.SentAt = sentAt.UTC().Format(time.RFC3339Nano)
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+func purgeTripMessages(ctx context.Context, retention time.Duration) (int64, error) {
+	res, err := dbPool.Exec(ctx, `DELETE FROM trip_messages WHERE created_at < now() - make_interval(secs => $1)`, retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected(), nil
+}
+
+// runChatRetention deletes chat messages older than cfg.ChatRetention once
+// an hour. Running it on several instances is harmless.
+func runChatRetention(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		purgeCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		if n, err := purgeTripMessages(purgeCtx, cfg.ChatRetention); err != nil {
+			log.Printf("chat retention purge failed: %v", err)
+		} else if n > 0 {
+			log.Printf("purged %d expired chat messages", n)
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
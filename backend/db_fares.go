@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"math"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Trips in the distance pricing mode charge each rider for the distance
+// actually travelled onboard rather than the fare quoted at booking. The
+// quote (ride_requests.total_fare) is taken to cover the booked segment,
+// pickup to drop along the planned route; the final fare scales it by
+// onboard distance over that segment and is rounded to FareRoundTo, then
+// held between FareMinRatio and FareMaxRatio of the quote; the bounds win
+// over rounding. Fixed-mode trips record the quote as the final fare.
+
+// settleFare computes and stores the final fare of a request that has just
+// been dropped off, inside the dropoff transaction. The breakdown is nil for
+// fixed-mode trips.
+func settleFare(ctx context.Context, tx pgx.Tx, requestID string) (*FareBreakdownPayload, error) {
+	const sql = `
+		WITH req AS (
+			SELECT rr.trip_id, rr.total_fare, rr.pickup_location, rr.drop_location, t.pricing_mode, t.route_id
+			FROM ride_requests rr
+			JOIN trips t ON t.id = rr.trip_id
+			WHERE rr.id = $1
+		), span AS (
+			SELECT
+				max(occurred_at) FILTER (WHERE event = 'rider_onboard') AS onboard_at,
+				max(occurred_at) FILTER (WHERE event = 'rider_dropped_off') AS dropped_at
+			FROM trip_events
+			WHERE request_id = $1
+		), driven AS (
+			SELECT ST_Length(ST_MakeLine(tt.location::geometry ORDER BY tt.recorded_at)::geography) AS m
+			FROM trip_trace tt, req, span
+			WHERE tt.trip_id = req.trip_id
+			  AND tt.recorded_at BETWEEN span.onboard_at AND span.dropped_at
+		), planned AS (
+			SELECT COALESCE(
+				(
+					SELECT abs(
+						ST_LineLocatePoint(r.geom::geometry, req.drop_location::geometry) -
+						ST_LineLocatePoint(r.geom::geometry, req.pickup_location::geometry)
+					) * COALESCE(r.length_m, ST_Length(r.geom))
+					FROM routes r
+					WHERE r.id = req.route_id AND r.geom IS NOT NULL
+				),
+				ST_Distance(req.pickup_location, req.drop_location)
+			) AS m
+			FROM req
+		)
+		SELECT req.pricing_mode, req.total_fare::float8, driven.m, planned.m
+		FROM req, driven, planned
+	`
+	var mode string
+	var quote float64
+	var drivenM *float64
+	var plannedM float64
+	if err := tx.QueryRow(ctx, sql, requestID).Scan(&mode, &quote, &drivenM, &plannedM); err != nil {
+		return nil, err
+	}
+
+	final := quote
+	var breakdown *FareBreakdownPayload
+	if mode == "distance" {
+		breakdown = prorateFare(quote, drivenM, plannedM)
+		final = breakdown.FinalFare
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE ride_requests SET final_fare = $2, onboard_distance_m = $3 WHERE id = $1
+	`, requestID, final, drivenM); err != nil {
+		return nil, err
+	}
+	return breakdown, nil
+}
+
+// prorateFare applies the distance pricing rules. Without a usable trace or
+// planned distance the quote stands.
+func prorateFare(quote float64, drivenM *float64, plannedM float64) *FareBreakdownPayload {
+	b := &FareBreakdownPayload{
+		Mode:             "distance",
+		QuotedFare:       quote,
+		PlannedDistanceM: math.Round(plannedM),
+		MinFare:          math.Round(quote*cfg.FareMinRatio*100) / 100,
+		MaxFare:          math.Round(quote*cfg.FareMaxRatio*100) / 100,
+		RoundTo:          cfg.FareRoundTo,
+	}
+	if drivenM == nil || *drivenM <= 0 || plannedM <= 0 {
+		b.FinalFare = quote
+		b.Adjustment = "no_trace"
+		return b
+	}
+	b.OnboardDistanceM = math.Round(*drivenM)
+
+	ratio := *drivenM / plannedM
+	b.DistanceRatio = math.Round(ratio*1000) / 1000
+	fare := roundFare(quote * ratio)
+	switch {
+	case fare < b.MinFare:
+		fare, b.Adjustment = b.MinFare, "minimum"
+	case fare > b.MaxFare:
+		fare, b.Adjustment = b.MaxFare, "maximum"
+	}
+	b.FinalFare = fare
+	return b
+}
+
+// roundFare rounds to the nearest FareRoundTo, or to the paisa when no
+// step is set.
+func roundFare(v float64) float64 {
+	step := cfg.FareRoundTo
+	if step <= 0 {
+		step = 0.01
+	}
+	return math.Round(math.Round(v/step)*step*100) / 100
+}
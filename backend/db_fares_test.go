@@ -0,0 +1,93 @@
+package main
+
+import "testing"
+
+func fareTestConfig(t *testing.T) {
+	useDefaultConfig(t)
+	cfg.FareMinRatio = 0.5
+	cfg.FareMaxRatio = 1
+	cfg.FareRoundTo = 5
+}
+
+func TestProrateFareScalesByOnboardDistance(t *testing.T) {
+	fareTestConfig(t)
+	driven := 8300.0
+
+	b := prorateFare(100, &driven, 10000)
+	if b.Mode != "distance" || b.QuotedFare != 100 {
+		t.Errorf("breakdown = %+v, want distance mode quoting 100", b)
+	}
+	if b.DistanceRatio != 0.83 || b.OnboardDistanceM != 8300 || b.PlannedDistanceM != 10000 {
+		t.Errorf("breakdown = %+v, want 8300m of 10000m", b)
+	}
+	// 83 rounds to the nearest 5.
+	if b.FinalFare != 85 || b.Adjustment != "" {
+		t.Errorf("final = %v (%q), want 85 unadjusted", b.FinalFare, b.Adjustment)
+	}
+}
+
+func TestProrateFareBounds(t *testing.T) {
+	fareTestConfig(t)
+	short, long := 2000.0, 13000.0
+
+	if b := prorateFare(100, &short, 10000); b.FinalFare != 50 || b.Adjustment != "minimum" {
+		t.Errorf("short ride: %v (%q), want 50 at the minimum", b.FinalFare, b.Adjustment)
+	}
+	if b := prorateFare(100, &long, 10000); b.FinalFare != 100 || b.Adjustment != "maximum" {
+		t.Errorf("long ride: %v (%q), want 100 at the maximum", b.FinalFare, b.Adjustment)
+	}
+
+	// Rounding to 5 would land outside the bounds; the bounds win.
+	half, full := 5100.0, 10000.0
+	if b := prorateFare(102, &half, 10000); b.FinalFare != 51 || b.Adjustment != "minimum" {
+		t.Errorf("rounded below the minimum: %v (%q), want 51", b.FinalFare, b.Adjustment)
+	}
+	if b := prorateFare(99, &full, 10000); b.FinalFare != 99 || b.Adjustment != "maximum" {
+		t.Errorf("rounded above the maximum: %v (%q), want 99", b.FinalFare, b.Adjustment)
+	}
+}
+
+func TestProrateFareWithoutTraceKeepsQuote(t *testing.T) {
+	fareTestConfig(t)
+	zero, some := 0.0, 8000.0
+
+	for _, b := range []*FareBreakdownPayload{
+		prorateFare(100, nil, 10000),
+		prorateFare(100, &zero, 10000),
+		prorateFare(100, &some, 0),
+	} {
+		if b.FinalFare != 100 || b.Adjustment != "no_trace" {
+			t.Errorf("final = %v (%q), want the quote with no_trace", b.FinalFare, b.Adjustment)
+		}
+	}
+}
+
+func TestRoundFare(t *testing.T) {
+	useDefaultConfig(t)
+
+	cfg.FareRoundTo = 0.5
+	if got := roundFare(10.24); got != 10 {
+		t.Errorf("roundFare(10.24) to 0.5 = %v, want 10", got)
+	}
+	if got := roundFare(10.26); got != 10.5 {
+		t.Errorf("roundFare(10.26) to 0.5 = %v, want 10.5", got)
+	}
+
+	// Without a step fares are kept to the paisa.
+	for _, step := range []float64{0, -1} {
+		cfg.FareRoundTo = step
+		if got := roundFare(12.346); got != 12.35 {
+			t.Errorf("roundFare(12.346) with step %v = %v, want 12.35", step, got)
+		}
+	}
+}
+
+func TestLoadLiveConfigRejectsInvertedFareRatios(t *testing.T) {
+	t.Setenv("FARE_MIN_RATIO", "1.2")
+	t.Setenv("FARE_MAX_RATIO", "0.8")
+	c := loadLiveConfig()
+	d := defaultLiveConfig()
+	if c.FareMinRatio != d.FareMinRatio || c.FareMaxRatio != d.FareMaxRatio {
+		t.Errorf("ratios = %v..%v, want the defaults %v..%v", c.FareMinRatio, c.FareMaxRatio, d.FareMinRatio, d.FareMaxRatio)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// sosIncident is the full incident record handed to outbound channels. It
+// carries contact details, so only SOSAlertPayload goes to the room.
+type sosIncident struct {
+	IncidentID      string          `json:"incidentId"`
+	TripID          string          `json:"tripId"`
+	RaisedBy        string          `json:"raisedBy"`
+	RaisedByName    string          `json:"raisedByName"`
+	RaisedByRole    string          `json:"raisedByRole"`
+	Lat             *float64        `json:"lat"`
+	Lng             *float64        `json:"lng"`
+	LocationSource  string          `json:"locationSource"`
+	LocationAt      string          `json:"locationAt,omitempty"`
+	Note            string          `json:"note,omitempty"`
+	Details         json.RawMessage `json:"details"`
+	Status          string          `json:"status"`
+	EscalationLevel int             `json:"escalationLevel"`
+	CreatedAt       string          `json:"createdAt"`
+}
+
+func (inc sosIncident) alertPayload() SOSAlertPayload {
+	return SOSAlertPayload{
+		IncidentID:     inc.IncidentID,
+		TripID:         inc.TripID,
+		RaisedBy:       inc.RaisedBy,
+		RaisedByName:   inc.RaisedByName,
+		RaisedByRole:   inc.RaisedByRole,
+		Lat:            inc.Lat,
+		Lng:            inc.Lng,
+		LocationSource: inc.LocationSource,
+		Note:           inc.Note,
+		CreatedAt:      inc.CreatedAt,
+	}
+}
+
+// createIncident snapshots the reporter's last live position (live_trips for
+// the driver, live_users for a rider) together with the trip, driver,
+// vehicle and rider details. reportedLat/Lng are only used when there is no
+// live row. A user has at most one open incident per trip; raising again
+// returns it with created false.
+func createIncident(ctx context.Context, tripID, userID, role, note string, reportedLat, reportedLng *float64) (sosIncident, bool, error) {
+	sql := `
+		INSERT INTO incidents (trip_id, raised_by, raised_by_role, location, location_source, location_recorded_at, note, details)
+		SELECT
+			t.id, $2, $3,
+			COALESCE(pos.current_location, ST_SetSRID(ST_MakePoint($6::float8, $5::float8), 4326)::geography),
+			CASE
+				WHEN pos.current_location IS NOT NULL THEN pos.source
+				WHEN $5::float8 IS NOT NULL AND $6::float8 IS NOT NULL THEN 'reported'
+			END,
+			CASE
+				WHEN pos.current_location IS NOT NULL THEN pos.last_updated
+				WHEN $5::float8 IS NOT NULL AND $6::float8 IS NOT NULL THEN now()
+			END,
+			NULLIF($4, ''),
+			jsonb_build_object(
+				'trip', jsonb_build_object(
+					'id', t.id, 'status', t.status, 'travelDate', t.travel_date,
+					'fromAddress', t.from_address, 'toAddress', t.to_address
+				),
+				'driver', jsonb_build_object('id', d.id, 'userId', du.id, 'name', du.name, 'phone', du.phone),
+				'vehicle', jsonb_build_object('number', d.vehicle_number, 'type', d.vehicle_type, 'info', d.vehicle_info),
+				'vehiclePosition', (
+					SELECT jsonb_build_object(
+						'lat', ST_Y(lt.current_location::geometry), 'lng', ST_X(lt.current_location::geometry),
+						'heading', lt.heading, 'speedKmph', lt.speed_kmph, 'updatedAt', lt.last_updated
+					)
+					FROM live_trips lt
+					WHERE lt.trip_id = t.id
+				),
+				'reporter', (SELECT jsonb_build_object('id', u.id, 'name', u.name, 'phone', u.phone) FROM users u WHERE u.id = $2),
+				'riders', COALESCE((
+					SELECT jsonb_agg(jsonb_build_object(
+						'requestId', rr.id, 'name', ru.name, 'phone', ru.phone, 'status', rr.status,
+						'pickupAddress', rr.pickup_address, 'dropAddress', rr.drop_address
+					))
+					FROM ride_requests rr
+					JOIN users ru ON ru.id = rr.rider_id
+					WHERE rr.trip_id = t.id AND rr.status IN ('waiting', 'onboard')
+				), '[]'::jsonb)
+			)
+		FROM trips t
+		JOIN drivers d ON d.id = t.driver_id
+		JOIN users du ON du.id = d.user_id
+		LEFT JOIN LATERAL (
+			SELECT lt.current_location, lt.last_updated, 'live_trips' AS source
+			FROM live_trips lt
+			WHERE $3 = 'driver' AND lt.trip_id = t.id
+			UNION ALL
+			SELECT lu.current_location, lu.last_updated, 'live_users'
+			FROM live_users lu
+			WHERE $3 = 'rider' AND lu.user_id = $2
+			LIMIT 1
+		) pos ON true
+		WHERE t.id = $1 AND t.status = 'ongoing'
+		ON CONFLICT (trip_id, raised_by) WHERE status = 'open' DO NOTHING
+		RETURNING id
+	`
+	var incidentID string
+	err := dbPool.QueryRow(ctx, sql, tripID, userID, role, note, reportedLat, reportedLng).Scan(&incidentID)
+	created := err == nil
+	if err == pgx.ErrNoRows {
+		// Either the trip is not ongoing or an incident is already open.
+		err = dbPool.QueryRow(ctx, `SELECT id FROM incidents WHERE trip_id = $1 AND raised_by = $2 AND status = 'open'`, tripID, userID).Scan(&incidentID)
+	}
+	if err != nil {
+		return sosIncident{}, false, err
+	}
+
+	inc, err := getIncident(ctx, incidentID)
+	return inc, created, err
+}
+
+func getIncident(ctx context.Context, incidentID string) (sosIncident, error) {
+	sql := `
+		SELECT
+			id, trip_id, raised_by, raised_by_role, COALESCE(details->'reporter'->>'name', ''),
+			ST_Y(location::geometry), ST_X(location::geometry),
+			COALESCE(location_source, 'unknown'), location_recorded_at,
+			COALESCE(note, ''), details, status, escalation_level, created_at
+		FROM incidents
+		WHERE id = $1
+	`
+	var inc sosIncident
+	var locationAt *time.Time
+	var createdAt time.Time
+	err := dbPool.QueryRow(ctx, sql, incidentID).Scan(
+		&inc.IncidentID, &inc.TripID, &inc.RaisedBy, &inc.RaisedByRole, &inc.RaisedByName,
+		&inc.Lat, &inc.Lng, &inc.LocationSource, &locationAt,
+		&inc.Note, &inc.Details, &inc.Status, &inc.EscalationLevel, &createdAt,
+	)
+	if err != nil {
+		return sosIncident{}, err
+	}
+	if locationAt != nil {
+		inc.LocationAt = locationAt.UTC().Format(time.RFC3339)
+	}
+	inc.CreatedAt = createdAt.UTC().Format(time.RFC3339)
+	return inc, nil
+}
+
+// acknowledgeIncident closes an open incident and returns its trip.
+func acknowledgeIncident(ctx context.Context, incidentID, by string) (string, time.Time, error) {
+	sql := `
+		UPDATE incidents
+		SET status = 'acknowledged', acknowledged_by = $2, acknowledged_at = now()
+		WHERE id = $1 AND status = 'open'
+		RETURNING trip_id, acknowledged_at
+	`
+	var tripID string
+	var at time.Time
+	if err := dbPool.QueryRow(ctx, sql, incidentID, by).Scan(&tripID, &at); err != nil {
+		return "", time.Time{}, err
+	}
+	return tripID, at, nil
+}
+
+// claimIncidentsForEscalation bumps the escalation level of every open
+// incident nobody acknowledged within after. The UPDATE hands each incident
+// to exactly one instance.
+func claimIncidentsForEscalation(ctx context.Context, after time.Duration, maxLevel int) ([]string, error) {
+	sql := `
+		UPDATE incidents
+		SET escalation_level = escalation_level + 1, last_notified_at = now()
+		WHERE status = 'open'
+		  AND escalation_level < $2
+		  AND last_notified_at < now() - make_interval(secs => $1)
+		RETURNING id
+	`
+	rows, err := dbPool.Query(ctx, sql, after.Seconds(), maxLevel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
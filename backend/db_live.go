@@ -44,51 +44,120 @@ func isRiderForTrip(ctx context.Context, tripID, userID string) bool {
 	return true
 }
 
-func upsertDriverLiveLocation(ctx context.Context, tripID, userID string, payload LocationUpdatePayload) error {
-	var driverID string
-	driverSQL := `
-		SELECT d.id
-		FROM drivers d
-		JOIN trips t ON t.driver_id = d.id
-		WHERE t.id = $1 AND d.user_id = $2
+// isTripParticipant is isDriverForTrip || isRiderForTrip without the
+// ongoing requirement, for records that stay readable once the trip ends
+// (chat history, the breadcrumb trail). Riders still waiting at completion
+// were cancelled by the trip, not by themselves, and keep access.
+func isTripParticipant(ctx context.Context, tripID, userID string) bool {
+	sql := `
+		SELECT 1
+		FROM trips t
+		JOIN drivers d ON d.id = t.driver_id
+		WHERE t.id = $1
+		  AND (
+			d.user_id = $2
+			OR EXISTS (
+				SELECT 1
+				FROM ride_requests rr
+				WHERE rr.trip_id = t.id
+				  AND rr.rider_id = $2
+				  AND (rr.status IN ('waiting', 'onboard', 'dropedoff') OR rr.cancelled_reason = 'Trip completed')
+			)
+		  )
 		LIMIT 1
 	`
-	if err := dbPool.QueryRow(ctx, driverSQL, tripID, userID).Scan(&driverID); err != nil {
-		return err
+	var one int
+	if err := dbPool.QueryRow(ctx, sql, tripID, userID).Scan(&one); err != nil {
+		return false
 	}
+	return true
+}
 
+// resolveTripAuth answers isDriverForTrip and isRiderForTrip in one round
+// trip and also returns the driver ID, the rider's active request and the
+// user's name for the caches in hub_auth.go.
+func resolveTripAuth(ctx context.Context, tripID, userID string) (tripAuth, error) {
 	sql := `
+		SELECT
+			CASE WHEN d.user_id = $2 THEN 'driver' ELSE 'rider' END,
+			d.id,
+			COALESCE(rr.id::text, ''),
+			u.name
+		FROM trips t
+		JOIN drivers d ON d.id = t.driver_id
+		JOIN users u ON u.id = $2
+		LEFT JOIN ride_requests rr
+			ON rr.trip_id = t.id
+		   AND rr.rider_id = $2
+		   AND rr.status IN ('waiting', 'onboard', 'dropedoff')
+		WHERE t.id = $1
+		  AND t.status = 'ongoing'
+		  AND (d.user_id = $2 OR rr.id IS NOT NULL)
+		LIMIT 1
+	`
+	var auth tripAuth
+	if err := dbPool.QueryRow(ctx, sql, tripID, userID).Scan(&auth.Role, &auth.DriverID, &auth.RequestID, &auth.Name); err != nil {
+		return tripAuth{}, err
+	}
+	return auth, nil
+}
+
+// writeLiveLocations upserts buffered positions and appends breadcrumbs in
+// one pipelined batch. Driver rows are only written while the trip is still
+// ongoing so a late flush cannot resurrect live_trips after completion.
+func writeLiveLocations(ctx context.Context, drivers []driverFix, riders []riderFix, trace []driverFix) error {
+	const driverSQL = `
 		INSERT INTO live_trips (trip_id, driver_id, current_location, heading, speed_kmph, last_updated)
-		VALUES ($1, $2, ST_SetSRID(ST_MakePoint($4, $3), 4326)::geography, $5, $6, now())
+		SELECT $1, $2, ST_SetSRID(ST_MakePoint($4, $3), 4326)::geography, $5, $6, $7
+		FROM trips
+		WHERE id = $1 AND status = 'ongoing'
 		ON CONFLICT (trip_id)
 		DO UPDATE SET
 			current_location = EXCLUDED.current_location,
 			heading = EXCLUDED.heading,
 			speed_kmph = EXCLUDED.speed_kmph,
-			last_updated = now()
+			last_updated = EXCLUDED.last_updated
 	`
-	_, err := dbPool.Exec(ctx, sql, tripID, driverID, payload.Lat, payload.Lng, payload.Heading, payload.SpeedKmph)
-	return err
-}
-
-func upsertRiderLiveLocation(ctx context.Context, userID string, payload LocationUpdatePayload) error {
-	sql := `
+	const riderSQL = `
 		INSERT INTO live_users (user_id, current_location, status, last_updated)
-		VALUES ($1, ST_SetSRID(ST_MakePoint($3, $2), 4326)::geography, 'trip_active', now())
+		VALUES ($1, ST_SetSRID(ST_MakePoint($3, $2), 4326)::geography, 'trip_active', $4)
 		ON CONFLICT (user_id)
 		DO UPDATE SET
 			current_location = EXCLUDED.current_location,
 			status = EXCLUDED.status,
-			last_updated = now()
+			last_updated = EXCLUDED.last_updated
 	`
-	_, err := dbPool.Exec(ctx, sql, userID, payload.Lat, payload.Lng)
-	return err
+
+	const traceSQL = `
+		INSERT INTO trip_trace (trip_id, recorded_at, location, heading, speed_kmph)
+		SELECT $1, $2, ST_SetSRID(ST_MakePoint($4, $3), 4326)::geography, $5, $6
+		FROM trips
+		WHERE id = $1 AND status = 'ongoing'
+	`
+
+	batch := &pgx.Batch{}
+	for _, fix := range trace {
+		batch.Queue(traceSQL, fix.tripID, fix.receivedAt, fix.payload.Lat, fix.payload.Lng, fix.payload.Heading, fix.payload.SpeedKmph)
+	}
+	for _, fix := range drivers {
+		batch.Queue(driverSQL, fix.tripID, fix.driverID, fix.payload.Lat, fix.payload.Lng, fix.payload.Heading, fix.payload.SpeedKmph, fix.receivedAt)
+	}
+	for _, fix := range riders {
+		batch.Queue(riderSQL, fix.userID, fix.payload.Lat, fix.payload.Lng, fix.receivedAt)
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	return dbPool.SendBatch(ctx, batch).Close()
 }
 
 func validateRiderDistanceForSelfAction(ctx context.Context, tripID, requestID, riderID, action string) (bool, string) {
 	if action != "onboard" && action != "dropoff" {
 		return false, "invalid rider action"
 	}
+	if err := liveLocations.FlushRider(ctx, riderID); err != nil {
+		return false, "failed to persist live location"
+	}
 
 	targetColumn := "rr.pickup_location"
 	expectedStatus := "waiting"
@@ -118,38 +187,180 @@ func validateRiderDistanceForSelfAction(ctx context.Context, tripID, requestID,
 	return true, ""
 }
 
-func setLiveUserStatus(ctx context.Context, userID, status string) error {
+// geofenceTargets returns the trip's pickups (waiting riders), drops
+// (onboard riders) and stops with their distance from the point. Only
+// targets within radiusM, or listed in tracked as kind:id, are returned.
+func geofenceTargets(ctx context.Context, tripID string, lat, lng, radiusM float64, tracked []string) ([]geofenceTarget, error) {
 	sql := `
-		UPDATE live_users
-		SET status = $2, last_updated = now()
-		WHERE user_id = $1
+		WITH here AS (
+			SELECT ST_SetSRID(ST_MakePoint($3, $2), 4326)::geography AS point
+		), targets AS (
+			SELECT 'pickup' AS kind, rr.id::text AS id, rr.rider_id::text AS rider_id, rr.pickup_address AS address, rr.pickup_location AS location
+			FROM ride_requests rr
+			WHERE rr.trip_id = $1 AND rr.status = 'waiting'
+			UNION ALL
+			SELECT 'drop', rr.id::text, rr.rider_id::text, rr.drop_address, rr.drop_location
+			FROM ride_requests rr
+			WHERE rr.trip_id = $1 AND rr.status = 'onboard'
+			UNION ALL
+			SELECT 'stop', ts.id::text, '', ts.stop_address, ts.stop_location
+			FROM trip_stops ts
+			WHERE ts.trip_id = $1 AND ts.departed_at IS NULL
+		)
+		SELECT tg.kind, tg.id, tg.rider_id, tg.address, ST_Distance(tg.location, here.point)
+		FROM targets tg
+		CROSS JOIN here
+		WHERE ST_DWithin(tg.location, here.point, $4)
+		   OR tg.kind || ':' || tg.id = ANY($5)
 	`
-	_, err := dbPool.Exec(ctx, sql, userID, status)
-	return err
-}
+	rows, err := dbPool.Query(ctx, sql, tripID, lat, lng, radiusM, tracked)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-func getUserName(ctx context.Context, userID string) string {
-	var name string
-	if err := dbPool.QueryRow(ctx, `SELECT name FROM users WHERE id = $1`, userID).Scan(&name); err != nil {
-		return "Rider"
+	var targets []geofenceTarget
+	for rows.Next() {
+		var t geofenceTarget
+		if err := rows.Scan(&t.kind, &t.id, &t.riderUserID, &t.address, &t.distanceM); err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
 	}
-	return name
+	return targets, rows.Err()
 }
 
-func getRequestIDForTripRider(ctx context.Context, tripID, riderID string) string {
-	var requestID string
+// routePosition measures a point against the trip's planned route.
+// pgx.ErrNoRows means the trip has no route geometry.
+type routePosition struct {
+	DistanceM  float64 // from the point to the line
+	Progress   float64 // where the closest point lies, 0 at the start to 1 at the end
+	SnappedLat float64
+	SnappedLng float64
+	LengthM    float64
+}
+
+func getRoutePosition(ctx context.Context, tripID string, lat, lng float64) (routePosition, error) {
 	sql := `
-		SELECT rr.id
-		FROM ride_requests rr
-		WHERE rr.trip_id = $1
-		  AND rr.rider_id = $2
-		  AND rr.status IN ('waiting', 'onboard', 'dropedoff')
-		LIMIT 1
+		WITH here AS (
+			SELECT ST_SetSRID(ST_MakePoint($3, $2), 4326) AS point
+		), located AS (
+			SELECT
+				r.geom,
+				COALESCE(r.length_m, ST_Length(r.geom)) AS length_m,
+				ST_LineLocatePoint(r.geom::geometry, here.point) AS fraction,
+				here.point
+			FROM trips t
+			JOIN routes r ON r.id = t.route_id
+			CROSS JOIN here
+			WHERE t.id = $1 AND r.geom IS NOT NULL
+		)
+		SELECT
+			ST_Distance(geom, point::geography),
+			fraction,
+			ST_Y(ST_LineInterpolatePoint(geom::geometry, fraction)),
+			ST_X(ST_LineInterpolatePoint(geom::geometry, fraction)),
+			length_m
+		FROM located
+	`
+	var p routePosition
+	err := dbPool.QueryRow(ctx, sql, tripID, lat, lng).Scan(&p.DistanceM, &p.Progress, &p.SnappedLat, &p.SnappedLng, &p.LengthM)
+	return p, err
+}
+
+// claimLostDriverSignals marks ongoing trips whose driver position is older
+// than timeout, or that have none timeout after starting, and returns their
+// last known position. A trip is returned once per outage, to whichever
+// caller marks it first. now is the application clock the positions are
+// stamped with, not the database's.
+func claimLostDriverSignals(ctx context.Context, now time.Time, timeout time.Duration) ([]DriverSignalPayload, error) {
+	sql := `
+		WITH lost AS (
+			SELECT t.id
+			FROM trips t
+			LEFT JOIN live_trips lt ON lt.trip_id = t.id
+			WHERE t.status = 'ongoing'
+			  AND t.signal_lost_at IS NULL
+			  AND COALESCE(lt.last_updated, t.started_at) < $1::timestamptz - make_interval(secs => $2)
+			FOR UPDATE OF t SKIP LOCKED
+		)
+		UPDATE trips t
+		SET signal_lost_at = $1
+		FROM lost
+		LEFT JOIN live_trips lt ON lt.trip_id = lost.id
+		WHERE t.id = lost.id
+		RETURNING
+			t.id, ST_Y(lt.current_location::geometry), ST_X(lt.current_location::geometry),
+			lt.heading::float8, lt.speed_kmph::float8, lt.last_updated,
+			COALESCE(lt.last_updated, t.started_at), t.signal_lost_at
 	`
-	if err := dbPool.QueryRow(ctx, sql, tripID, riderID).Scan(&requestID); err != nil {
-		return ""
+	rows, err := dbPool.Query(ctx, sql, now, timeout.Seconds())
+	return scanDriverSignals(rows, err, now)
+}
+
+// claimRestoredDriverSignals clears the mark on trips that have received a
+// position since their signal was lost.
+func claimRestoredDriverSignals(ctx context.Context, now time.Time) ([]DriverSignalPayload, error) {
+	sql := `
+		WITH restored AS (
+			SELECT t.id, t.signal_lost_at
+			FROM trips t
+			JOIN live_trips lt ON lt.trip_id = t.id
+			WHERE t.signal_lost_at IS NOT NULL AND lt.last_updated > t.signal_lost_at
+			FOR UPDATE OF t SKIP LOCKED
+		)
+		UPDATE trips t
+		SET signal_lost_at = NULL
+		FROM restored r
+		JOIN live_trips lt ON lt.trip_id = r.id
+		WHERE t.id = r.id
+		RETURNING
+			t.id, ST_Y(lt.current_location::geometry), ST_X(lt.current_location::geometry),
+			lt.heading::float8, lt.speed_kmph::float8, lt.last_updated,
+			lt.last_updated, r.signal_lost_at
+	`
+	rows, err := dbPool.Query(ctx, sql)
+	return scanDriverSignals(rows, err, now)
+}
+
+func scanDriverSignals(rows pgx.Rows, err error, now time.Time) ([]DriverSignalPayload, error) {
+	if err != nil {
+		return nil, err
 	}
-	return requestID
+	defer rows.Close()
+
+	var out []DriverSignalPayload
+	for rows.Next() {
+		var p DriverSignalPayload
+		var lastSeen *time.Time
+		var silentSince, lostAt time.Time
+		if err := rows.Scan(&p.TripID, &p.Lat, &p.Lng, &p.Heading, &p.SpeedKmph, &lastSeen, &silentSince, &lostAt); err != nil {
+			return nil, err
+		}
+		if lastSeen != nil {
+			p.LastSeenAt = lastSeen.UTC().Format(time.RFC3339)
+		}
+		p.AgeSeconds = now.Sub(silentSince).Seconds()
+		p.LostAt = lostAt.UTC().Format(time.RFC3339)
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+func getTripDriverUserID(ctx context.Context, tripID string) (string, error) {
+	var userID string
+	err := dbPool.QueryRow(ctx, `SELECT d.user_id FROM trips t JOIN drivers d ON d.id = t.driver_id WHERE t.id = $1`, tripID).Scan(&userID)
+	return userID, err
+}
+
+func setLiveUserStatus(ctx context.Context, userID, status string) error {
+	sql := `
+		UPDATE live_users
+		SET status = $2, last_updated = now()
+		WHERE user_id = $1
+	`
+	_, err := dbPool.Exec(ctx, sql, userID, status)
+	return err
 }
 
 func startTripByDriver(ctx context.Context, tripID, userID string) (bool, string) {
@@ -194,14 +405,17 @@ func startTripByDriver(ctx context.Context, tripID, userID string) (bool, string
 		return false, "You already have an ongoing trip."
 	}
 
+	// started_at and the live row carry the application clock, like the
+	// positions the signal watchdog compares them with.
+	startedAt := time.Now()
 	tag, err := tx.Exec(ctx, `
 		UPDATE trips
-		SET status = 'ongoing', updated_at = now()
+		SET status = 'ongoing', started_at = $3, updated_at = now()
 		WHERE id = $1
 		  AND driver_id = $2
 		  AND status = 'scheduled'
 		  AND travel_date <= now()
-	`, tripID, driverID)
+	`, tripID, driverID, startedAt)
 	if err != nil {
 		return false, "Failed to start trip."
 	}
@@ -213,7 +427,7 @@ func startTripByDriver(ctx context.Context, tripID, userID string) (bool, string
 		return false, "Failed to initialize live trip."
 	}
 
-	if _, err := tx.Exec(ctx, `INSERT INTO live_trips (trip_id, driver_id, current_location, heading, speed_kmph, last_updated) VALUES ($1, $2, ST_GeogFromText($3), NULL, NULL, now())`, tripID, driverID, fromLocation); err != nil {
+	if _, err := tx.Exec(ctx, `INSERT INTO live_trips (trip_id, driver_id, current_location, heading, speed_kmph, last_updated) VALUES ($1, $2, ST_GeogFromText($3), NULL, NULL, $4)`, tripID, driverID, fromLocation, startedAt); err != nil {
 		return false, "Failed to initialize live trip."
 	}
 
@@ -228,20 +442,29 @@ func startTripByDriver(ctx context.Context, tripID, userID string) (bool, string
 		return false, "Failed to initialize riders."
 	}
 
+	if _, err := tx.Exec(ctx, `INSERT INTO trip_events (trip_id, event, occurred_at) VALUES ($1, 'trip_started', $2)`, tripID, startedAt); err != nil {
+		return false, "Failed to record trip start."
+	}
+
 	if err := tx.Commit(ctx); err != nil {
 		return false, "Failed to commit trip start."
 	}
 
 	hub.EnsureRoom(tripID)
+	hub.InvalidateAuth(tripID, "")
 	hub.BroadcastToTrip(tripID, SocketResponse{
 		Event:   "trip_started",
-		Payload: map[string]interface{}{"tripId": tripID, "status": "ongoing"},
+		Payload: TripStatusPayload{TripID: tripID, Status: "ongoing"},
 	})
 
 	return true, ""
 }
 
 func completeTripByDriver(ctx context.Context, tripID, userID string) (bool, string) {
+	if err := liveLocations.FlushTrip(ctx, tripID); err != nil {
+		return false, "Failed to persist live location."
+	}
+
 	tx, err := dbPool.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
 		return false, "failed to start transaction"
@@ -274,6 +497,40 @@ func completeTripByDriver(ctx context.Context, tripID, userID string) (bool, str
 		return false, "Trip is not ongoing or not owned by driver."
 	}
 
+	// Riders still onboard are dropped off by completion.
+	rows, err := tx.Query(ctx, `
+		INSERT INTO trip_events (trip_id, event, request_id, occurred_at)
+		SELECT $1, 'rider_dropped_off', rr.id, $2
+		FROM ride_requests rr
+		WHERE rr.trip_id = $1 AND rr.status = 'onboard'
+		UNION ALL
+		SELECT $1, 'trip_completed', NULL, $2
+		RETURNING COALESCE(request_id::text, '')
+	`, tripID, time.Now())
+	if err != nil {
+		return false, "Failed to record trip completion."
+	}
+	var droppedOff []RiderStatusPayload
+	for rows.Next() {
+		var requestID string
+		if err := rows.Scan(&requestID); err != nil {
+			rows.Close()
+			return false, "Failed to record trip completion."
+		}
+		if requestID != "" {
+			droppedOff = append(droppedOff, RiderStatusPayload{TripID: tripID, RequestID: requestID, Status: "dropedoff"})
+		}
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return false, "Failed to record trip completion."
+	}
+	for i := range droppedOff {
+		if droppedOff[i].Fare, err = settleFare(ctx, tx, droppedOff[i].RequestID); err != nil {
+			return false, "Failed to settle fares."
+		}
+	}
+
 	if _, err := tx.Exec(ctx, `
 		UPDATE ride_requests
 		SET
@@ -296,6 +553,30 @@ func completeTripByDriver(ctx context.Context, tripID, userID string) (bool, str
 		return false, "Failed to reconcile rider statuses."
 	}
 
+	// Keep a simplified copy of the path actually driven, and its full
+	// length, on the trip itself.
+	if _, err := tx.Exec(ctx, `
+		UPDATE trips t
+		SET driven_path = p.path, driven_distance_m = p.length_m
+		FROM (
+			SELECT ST_Simplify(line, $2, true)::geography AS path, ST_Length(line::geography) AS length_m
+			FROM (
+				SELECT ST_MakeLine(location::geometry ORDER BY recorded_at) AS line
+				FROM trip_trace
+				WHERE trip_id = $1
+			) l
+			WHERE ST_NPoints(line) >= 2
+		) p
+		WHERE t.id = $1
+	`, tripID, cfg.TraceSimplifyM/metresPerDegree); err != nil {
+		return false, "Failed to store driven path."
+	}
+
+	departedStops, skippedStops, err := closeTripStops(ctx, tx, tripID, time.Now())
+	if err != nil {
+		return false, "Failed to settle trip stops."
+	}
+
 	if _, err := tx.Exec(ctx, `
 		DELETE FROM live_users lu
 		WHERE lu.user_id = $2
@@ -312,44 +593,81 @@ func completeTripByDriver(ctx context.Context, tripID, userID string) (bool, str
 		return false, "Failed to clear live trip."
 	}
 
+	if _, err := tx.Exec(ctx, `UPDATE trip_share_links SET revoked_at = now() WHERE trip_id = $1 AND revoked_at IS NULL`, tripID); err != nil {
+		return false, "Failed to revoke share links."
+	}
+
 	if err := tx.Commit(ctx); err != nil {
 		return false, "Failed to complete trip."
 	}
+	liveLocations.ForgetTrip(tripID)
+	for _, stop := range departedStops {
+		hub.BroadcastToTrip(tripID, SocketResponse{Event: "stop_departed", Payload: stop})
+	}
+	for _, stop := range skippedStops {
+		hub.BroadcastToTrip(tripID, SocketResponse{Event: "stop_skipped", Payload: stop})
+	}
+	for _, rider := range droppedOff {
+		hub.BroadcastToTrip(tripID, SocketResponse{Event: "rider_dropped_off", Payload: rider})
+	}
 
 	hub.BroadcastToTrip(tripID, SocketResponse{
 		Event:   "trip_completed",
-		Payload: map[string]interface{}{"tripId": tripID, "status": "completed"},
+		Payload: TripStatusPayload{TripID: tripID, Status: "completed"},
 	})
 	hub.CloseRoom(tripID)
 	return true, ""
 }
 
 func markRiderOnboardByRider(ctx context.Context, requestID, riderID string) (bool, string, string) {
+	if err := liveLocations.FlushRider(ctx, riderID); err != nil {
+		return false, "", "Failed to persist live location."
+	}
+
 	const sql = `
-		UPDATE ride_requests rr
-		SET status = 'onboard', updated_at = now()
-		FROM trips t
-		JOIN live_users lu ON lu.user_id = rr.rider_id
-		WHERE rr.id = $1
-		  AND rr.rider_id = $2
-		  AND rr.trip_id = t.id
-		  AND t.status = 'ongoing'
-		  AND rr.status = 'waiting'
-		  AND ST_DWithin(lu.current_location, rr.pickup_location, 100)
-		RETURNING rr.trip_id
+		WITH boarded AS (
+			UPDATE ride_requests rr
+			SET status = 'onboard', updated_at = now()
+			FROM trips t
+			JOIN live_users lu ON lu.user_id = rr.rider_id
+			WHERE rr.id = $1
+			  AND rr.rider_id = $2
+			  AND rr.trip_id = t.id
+			  AND t.status = 'ongoing'
+			  AND rr.status = 'waiting'
+			  AND ST_DWithin(lu.current_location, rr.pickup_location, 100)
+			RETURNING rr.trip_id
+		)
+		INSERT INTO trip_events (trip_id, event, request_id, occurred_at)
+		SELECT trip_id, 'rider_onboard', $1, $3 FROM boarded
+		RETURNING trip_id
 	`
 	var tripID string
-	if err := dbPool.QueryRow(ctx, sql, requestID, riderID).Scan(&tripID); err != nil {
+	if err := dbPool.QueryRow(ctx, sql, requestID, riderID, time.Now()).Scan(&tripID); err != nil {
 		return false, "", "Unable to mark onboard. Be within 100m of pickup and trip must be ongoing."
 	}
+	hub.InvalidateAuth(tripID, riderID)
 	hub.BroadcastToTrip(tripID, SocketResponse{
 		Event:   "rider_onboard",
-		Payload: map[string]interface{}{"tripId": tripID, "requestId": requestID, "status": "onboard"},
+		Payload: RiderStatusPayload{TripID: tripID, RequestID: requestID, Status: "onboard"},
 	})
 	return true, tripID, ""
 }
 
 func markRiderDroppedOffByRider(ctx context.Context, requestID, riderID string) (bool, string, string) {
+	// The fare is settled from the trip's breadcrumbs, so those have to be
+	// written before the transaction reads them.
+	var requestTripID string
+	if err := dbPool.QueryRow(ctx, `SELECT trip_id FROM ride_requests WHERE id = $1 AND rider_id = $2`, requestID, riderID).Scan(&requestTripID); err != nil {
+		return false, "", "Unable to drop off. Be within 100m of destination and status must be onboard."
+	}
+	if err := liveLocations.FlushRider(ctx, riderID); err != nil {
+		return false, "", "Failed to persist live location."
+	}
+	if err := liveLocations.FlushTrip(ctx, requestTripID); err != nil {
+		return false, "", "Failed to persist live location."
+	}
+
 	tx, err := dbPool.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
 		return false, "", "failed to start transaction"
@@ -385,14 +703,24 @@ func markRiderDroppedOffByRider(ctx context.Context, requestID, riderID string)
 	if _, err := tx.Exec(ctx, `DELETE FROM live_users WHERE user_id = $1`, riderID); err != nil {
 		return false, "", "Failed to clear rider live status."
 	}
+	if _, err := tx.Exec(ctx, `INSERT INTO trip_events (trip_id, event, request_id, occurred_at) VALUES ($1, 'rider_dropped_off', $2, $3)`, tripID, requestID, time.Now()); err != nil {
+		return false, "", "Failed to record dropoff."
+	}
+	fare, err := settleFare(ctx, tx, requestID)
+	if err != nil {
+		return false, "", "Failed to settle fare."
+	}
 
 	if err := tx.Commit(ctx); err != nil {
 		return false, "", "Failed to commit dropoff."
 	}
+	liveLocations.ForgetRider(riderID)
+	hub.ForgetFilter(tripID, "rider:"+riderID)
+	hub.InvalidateAuth(tripID, riderID)
 
 	hub.BroadcastToTrip(tripID, SocketResponse{
 		Event:   "rider_dropped_off",
-		Payload: map[string]interface{}{"tripId": tripID, "requestId": requestID, "status": "dropedoff"},
+		Payload: RiderStatusPayload{TripID: tripID, RequestID: requestID, Status: "dropedoff", Fare: fare},
 	})
 	return true, tripID, ""
 }
@@ -403,7 +731,7 @@ func getLiveTripViewByID(ctx context.Context, tripID, userID string) (map[string
 		FROM (
 			SELECT
 				t.id as trip_id, t.from_address, t.to_address, t.travel_date,
-				t.fare_per_seat, t.total_seats, t.available_seats, t.description, t.status as trip_status,
+				t.fare_per_seat, t.pricing_mode, t.total_seats, t.available_seats, t.description, t.status as trip_status,
 				ST_Y(t.from_location::geometry) as from_lat, ST_X(t.from_location::geometry) as from_lng,
 				ST_Y(t.to_location::geometry) as to_lat, ST_X(t.to_location::geometry) as to_lng,
 				u.name as driver_name, d.avg_rating as driver_rating,
@@ -419,18 +747,31 @@ func getLiveTripViewByID(ctx context.Context, tripID, userID string) (map[string
 					SELECT COALESCE(json_agg(ts), '[]')
 					FROM (
 						SELECT id, stop_address, stop_order,
-							   ST_Y(stop_location::geometry) as lat, ST_X(stop_location::geometry) as lng
+							   ST_Y(stop_location::geometry) as lat, ST_X(stop_location::geometry) as lng,
+							   arrived_at, departed_at, skipped_at
 						FROM trip_stops
 						WHERE trip_id = t.id
 						ORDER BY stop_order
 					) ts
 				) as stops,
+				(
+					SELECT row_to_json(ns)
+					FROM (
+						SELECT id, stop_address, stop_order,
+							   ST_Y(stop_location::geometry) as lat, ST_X(stop_location::geometry) as lng,
+							   arrived_at
+						FROM trip_stops
+						WHERE trip_id = t.id AND departed_at IS NULL AND skipped_at IS NULL
+						ORDER BY stop_order
+						LIMIT 1
+					) ns
+				) as next_stop,
 				CASE
 					WHEN $2::uuid = u.id THEN (
 						SELECT COALESCE(json_agg(rd), '[]')
 						FROM (
-							SELECT rr.id as request_id, ru.name as rider_name,
-								   rr.pickup_address, rr.drop_address, rr.seats, rr.total_fare, rr.status,
+							SELECT rr.id as request_id, rr.rider_id, ru.name as rider_name,
+								   rr.pickup_address, rr.drop_address, rr.seats, rr.total_fare, rr.final_fare, rr.status,
 								   ST_Y(rr.pickup_location::geometry) as pickup_lat, ST_X(rr.pickup_location::geometry) as pickup_lng,
 								   ST_Y(rr.drop_location::geometry) as drop_lat, ST_X(rr.drop_location::geometry) as drop_lng
 							FROM ride_requests rr
@@ -446,6 +787,7 @@ func getLiveTripViewByID(ctx context.Context, tripID, userID string) (map[string
 						'status', my_rr.status,
 						'seats', my_rr.seats,
 						'total_fare', my_rr.total_fare,
+						'final_fare', my_rr.final_fare,
 						'pickup_address', my_rr.pickup_address,
 						'drop_address', my_rr.drop_address
 					)
@@ -486,7 +828,7 @@ func getCurrentDriverLiveTripByUserID(ctx context.Context, userID string) (map[s
 		FROM (
 			SELECT
 				t.id as trip_id, t.from_address, t.to_address, t.travel_date,
-				t.fare_per_seat, t.total_seats, t.available_seats, t.description, t.status as trip_status,
+				t.fare_per_seat, t.pricing_mode, t.total_seats, t.available_seats, t.description, t.status as trip_status,
 				ST_Y(t.from_location::geometry) as from_lat, ST_X(t.from_location::geometry) as from_lng,
 				ST_Y(t.to_location::geometry) as to_lat, ST_X(t.to_location::geometry) as to_lng,
 				u.name as driver_name, d.avg_rating as driver_rating,
@@ -502,17 +844,30 @@ func getCurrentDriverLiveTripByUserID(ctx context.Context, userID string) (map[s
 					SELECT COALESCE(json_agg(ts), '[]')
 					FROM (
 						SELECT id, stop_address, stop_order,
-							   ST_Y(stop_location::geometry) as lat, ST_X(stop_location::geometry) as lng
+							   ST_Y(stop_location::geometry) as lat, ST_X(stop_location::geometry) as lng,
+							   arrived_at, departed_at, skipped_at
 						FROM trip_stops
 						WHERE trip_id = t.id
 						ORDER BY stop_order
 					) ts
 				) as stops,
+				(
+					SELECT row_to_json(ns)
+					FROM (
+						SELECT id, stop_address, stop_order,
+							   ST_Y(stop_location::geometry) as lat, ST_X(stop_location::geometry) as lng,
+							   arrived_at
+						FROM trip_stops
+						WHERE trip_id = t.id AND departed_at IS NULL AND skipped_at IS NULL
+						ORDER BY stop_order
+						LIMIT 1
+					) ns
+				) as next_stop,
 				(
 					SELECT COALESCE(json_agg(rd), '[]')
 					FROM (
-						SELECT rr.id as request_id, ru.name as rider_name,
-							   rr.pickup_address, rr.drop_address, rr.seats, rr.total_fare, rr.status,
+						SELECT rr.id as request_id, rr.rider_id, ru.name as rider_name,
+							   rr.pickup_address, rr.drop_address, rr.seats, rr.total_fare, rr.final_fare, rr.status,
 							   ST_Y(rr.pickup_location::geometry) as pickup_lat, ST_X(rr.pickup_location::geometry) as pickup_lng,
 							   ST_Y(rr.drop_location::geometry) as drop_lat, ST_X(rr.drop_location::geometry) as drop_lng,
 							   COALESCE(ST_Y(lu.current_location::geometry), ST_Y(rr.pickup_location::geometry)) as current_lat,
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+func createTripShareLink(ctx context.Context, tripID, userID string, expiresAt time.Time) (string, error) {
+	sql := `
+		INSERT INTO trip_share_links (trip_id, created_by, expires_at)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`
+	var shareID string
+	if err := dbPool.QueryRow(ctx, sql, tripID, userID, expiresAt).Scan(&shareID); err != nil {
+		return "", err
+	}
+	return shareID, nil
+}
+
+func isTripShareLinkActive(ctx context.Context, shareID, tripID string) bool {
+	sql := `
+		SELECT 1
+		FROM trip_share_links sl
+		JOIN trips t ON t.id = sl.trip_id
+		WHERE sl.id = $1
+		  AND sl.trip_id = $2
+		  AND sl.revoked_at IS NULL
+		  AND sl.expires_at > now()
+		  AND t.status = 'ongoing'
+		LIMIT 1
+	`
+	var one int
+	if err := dbPool.QueryRow(ctx, sql, shareID, tripID).Scan(&one); err != nil {
+		return false
+	}
+	return true
+}
+
+// revokeTripShareLink revokes a link created by userID and returns its trip.
+func revokeTripShareLink(ctx context.Context, shareID, userID string) (string, bool) {
+	sql := `
+		UPDATE trip_share_links
+		SET revoked_at = now()
+		WHERE id = $1
+		  AND created_by = $2
+		  AND revoked_at IS NULL
+		RETURNING trip_id
+	`
+	var tripID string
+	if err := dbPool.QueryRow(ctx, sql, shareID, userID).Scan(&tripID); err != nil {
+		return "", false
+	}
+	return tripID, true
+}
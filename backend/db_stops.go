@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Stop visits are written with conditional updates, so when several
+// instances see the same fix only the first records it and broadcasts.
+
+// markStopArrived records the first arrival at a stop. Earlier stops
+// (by stop_order) that were never reached are marked skipped and returned
+// alongside it. Reaching a stop already marked skipped clears the mark:
+// the driver came back for it. ok is false when the arrival was already
+// recorded.
+func markStopArrived(ctx context.Context, tripID, stopID string, at time.Time) (stop StopEventPayload, skipped []StopEventPayload, ok bool, err error) {
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		return stop, nil, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, `
+		UPDATE trip_stops
+		SET arrived_at = $3, skipped_at = NULL
+		WHERE id = $2 AND trip_id = $1 AND arrived_at IS NULL
+		RETURNING id, stop_order, stop_address
+	`, tripID, stopID, at).Scan(&stop.StopID, &stop.StopOrder, &stop.Address)
+	if err == pgx.ErrNoRows {
+		return stop, nil, false, nil
+	}
+	if err != nil {
+		return stop, nil, false, err
+	}
+	stop.TripID = tripID
+	stop.At = at.UTC().Format(time.RFC3339)
+
+	skipped, err = skipStops(ctx, tx, tripID, &stop.StopOrder, at, "later_stop_reached")
+	if err != nil {
+		return stop, nil, false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return stop, nil, false, err
+	}
+	return stop, skipped, true, nil
+}
+
+// markStopDeparted records leaving a stop that was reached.
+func markStopDeparted(ctx context.Context, tripID, stopID string, at time.Time) (StopEventPayload, bool, error) {
+	stop := StopEventPayload{TripID: tripID, At: at.UTC().Format(time.RFC3339)}
+	err := dbPool.QueryRow(ctx, `
+		UPDATE trip_stops
+		SET departed_at = $3
+		WHERE id = $2 AND trip_id = $1 AND arrived_at IS NOT NULL AND departed_at IS NULL
+		RETURNING id, stop_order, stop_address
+	`, tripID, stopID, at).Scan(&stop.StopID, &stop.StopOrder, &stop.Address)
+	if err == pgx.ErrNoRows {
+		return stop, false, nil
+	}
+	return stop, err == nil, err
+}
+
+// skipStops marks unreached stops as skipped: those before beforeOrder, or
+// all of them when beforeOrder is nil.
+func skipStops(ctx context.Context, tx pgx.Tx, tripID string, beforeOrder *int, at time.Time, reason string) ([]StopEventPayload, error) {
+	rows, err := tx.Query(ctx, `
+		UPDATE trip_stops
+		SET skipped_at = $3
+		WHERE trip_id = $1
+		  AND ($2::int IS NULL OR stop_order < $2)
+		  AND arrived_at IS NULL
+		  AND skipped_at IS NULL
+		RETURNING id, stop_order, stop_address
+	`, tripID, beforeOrder, at)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var skipped []StopEventPayload
+	for rows.Next() {
+		s := StopEventPayload{TripID: tripID, At: at.UTC().Format(time.RFC3339), Reason: reason}
+		if err := rows.Scan(&s.StopID, &s.StopOrder, &s.Address); err != nil {
+			return nil, err
+		}
+		skipped = append(skipped, s)
+	}
+	return skipped, rows.Err()
+}
+
+// closeTripStops settles every stop when the trip completes: a stop the
+// driver is still at counts as departed, and stops never reached as
+// skipped.
+func closeTripStops(ctx context.Context, tx pgx.Tx, tripID string, at time.Time) (departed, skipped []StopEventPayload, err error) {
+	rows, err := tx.Query(ctx, `
+		UPDATE trip_stops
+		SET departed_at = $2
+		WHERE trip_id = $1 AND arrived_at IS NOT NULL AND departed_at IS NULL
+		RETURNING id, stop_order, stop_address
+	`, tripID, at)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		s := StopEventPayload{TripID: tripID, At: at.UTC().Format(time.RFC3339)}
+		if err := rows.Scan(&s.StopID, &s.StopOrder, &s.Address); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		departed = append(departed, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	skipped, err = skipStops(ctx, tx, tripID, nil, at, "trip_completed")
+	return departed, skipped, err
+}
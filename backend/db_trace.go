@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type tracePoint struct {
+	RecordedAt time.Time
+	Lat        float64
+	Lng        float64
+	Heading    *float64
+	SpeedKmph  *float64
+}
+
+// getTripTrace returns a trip's breadcrumbs in the order they were recorded.
+func getTripTrace(ctx context.Context, tripID string) ([]tracePoint, error) {
+	sql := `
+		SELECT recorded_at, ST_Y(location::geometry), ST_X(location::geometry), heading::float8, speed_kmph::float8
+		FROM trip_trace
+		WHERE trip_id = $1
+		ORDER BY recorded_at
+	`
+	rows, err := dbPool.Query(ctx, sql, tripID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []tracePoint
+	for rows.Next() {
+		var p tracePoint
+		if err := rows.Scan(&p.RecordedAt, &p.Lat, &p.Lng, &p.Heading, &p.SpeedKmph); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+type tripEvent struct {
+	Event      string
+	RequestID  string
+	OccurredAt time.Time
+}
+
+// getTripEvents returns a trip's recorded lifecycle events in order.
+func getTripEvents(ctx context.Context, tripID string) ([]tripEvent, error) {
+	sql := `
+		SELECT event, COALESCE(request_id::text, ''), occurred_at
+		FROM trip_events
+		WHERE trip_id = $1
+		ORDER BY occurred_at, event = 'trip_completed'
+	`
+	rows, err := dbPool.Query(ctx, sql, tripID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []tripEvent
+	for rows.Next() {
+		var e tripEvent
+		if err := rows.Scan(&e.Event, &e.RequestID, &e.OccurredAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func getTripStatus(ctx context.Context, tripID string) (string, error) {
+	var status string
+	err := dbPool.QueryRow(ctx, `SELECT status FROM trips WHERE id = $1`, tripID).Scan(&status)
+	return status, err
+}
+
+// ensureTracePartitions creates the monthly trip_trace partitions for the
+// month containing now and the one after it, plus any month that already
+// has rows in the default partition. Postgres refuses to create a partition
+// whose range the default partition holds rows for, so those rows are moved
+// across: the default is detached, the partition created, the rows moved
+// and the default reattached, in one transaction. An advisory lock keeps
+// instances from racing each other.
+func ensureTracePartitions(ctx context.Context, now time.Time) error {
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('trip_trace_partitions'))`); err != nil {
+		return err
+	}
+
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	months := []time.Time{month, month.AddDate(0, 1, 0)}
+	rows, err := tx.Query(ctx, `
+		SELECT DISTINCT date_trunc('month', recorded_at AT TIME ZONE 'UTC')
+		FROM trip_trace_default
+	`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var m time.Time
+		if err := rows.Scan(&m); err != nil {
+			rows.Close()
+			return err
+		}
+		m = time.Date(m.Year(), m.Month(), 1, 0, 0, 0, 0, time.UTC)
+		if !slices.ContainsFunc(months, m.Equal) {
+			months = append(months, m)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, from := range months {
+		if err := createTracePartition(ctx, tx, from); err != nil {
+			return fmt.Errorf("trip_trace partition for %s: %w", from.Format("2006-01"), err)
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func createTracePartition(ctx context.Context, tx pgx.Tx, from time.Time) error {
+	to := from.AddDate(0, 1, 0)
+	name := fmt.Sprintf("trip_trace_y%04dm%02d", from.Year(), int(from.Month()))
+
+	var exists bool
+	if err := tx.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, name).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	var stranded bool
+	if err := tx.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM trip_trace_default WHERE recorded_at >= $1 AND recorded_at < $2)
+	`, from, to).Scan(&stranded); err != nil {
+		return err
+	}
+
+	create := fmt.Sprintf(
+		`CREATE TABLE %s PARTITION OF trip_trace FOR VALUES FROM ('%s') TO ('%s')`,
+		name, from.Format(time.RFC3339), to.Format(time.RFC3339),
+	)
+	if !stranded {
+		_, err := tx.Exec(ctx, create)
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, `ALTER TABLE trip_trace DETACH PARTITION trip_trace_default`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, create); err != nil {
+		return err
+	}
+	tag, err := tx.Exec(ctx, `
+		WITH moved AS (
+			DELETE FROM trip_trace_default
+			WHERE recorded_at >= $1 AND recorded_at < $2
+			RETURNING *
+		)
+		INSERT INTO trip_trace SELECT * FROM moved
+	`, from, to)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `ALTER TABLE trip_trace ATTACH PARTITION trip_trace_default DEFAULT`); err != nil {
+		return err
+	}
+	log.Printf("moved %d breadcrumbs from trip_trace_default into %s", tag.RowsAffected(), name)
+	return nil
+}
+
+// runTracePartitions keeps partitions ahead of the calendar. main runs the
+// first pass itself and refuses to start if it fails.
+func runTracePartitions(ctx context.Context) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		partCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		if err := ensureTracePartitions(partCtx, time.Now().UTC()); err != nil {
+			log.Printf("trip_trace partitions: %v", err)
+		}
+		cancel()
+	}
+}
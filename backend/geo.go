@@ -0,0 +1,25 @@
+package main
+
+import "math"
+
+const earthRadiusM = 6371000.0
+
+// metresPerDegree converts metre tolerances to degrees for geometry
+// functions in SRID 4326. It is exact along a meridian and close enough
+// elsewhere for simplification.
+const metresPerDegree = 111320.0
+
+// haversineMeters is the great-circle distance between two WGS84 points.
+func haversineMeters(lat1, lng1, lat2, lng2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLng := (lng2 - lng1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusM * math.Asin(math.Sqrt(a))
+}
+
+func validCoordinates(lat, lng float64) bool {
+	return !math.IsNaN(lat) && !math.IsNaN(lng) &&
+		lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180
+}
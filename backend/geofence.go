@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Geofences are evaluated on every driver fix that leaves the coalescer.
+// Each pickup (waiting rider), drop (onboard rider) and trip stop moves
+// through outside -> approaching -> arrived -> departed. Leaving a zone
+// needs the driver to be GeofenceHysteresisM beyond its radius, so a fix
+// wobbling across the boundary does not flap. State lives on the instance
+// the driver is connected to; a driver reconnecting elsewhere starts fresh.
+
+type geofenceZone int
+
+const (
+	zoneOutside geofenceZone = iota
+	zoneApproaching
+	zoneArrived
+	zoneDeparted
+)
+
+type geofenceTarget struct {
+	kind        string // pickup, drop or stop
+	id          string // ride request or trip stop ID
+	riderUserID string
+	address     string
+	distanceM   float64
+}
+
+func (t geofenceTarget) key() string { return t.kind + ":" + t.id }
+
+type tripGeofences struct {
+	driverUserID string
+	zones        map[string]geofenceZone
+}
+
+type geofenceTracker struct {
+	mu    sync.Mutex
+	trips map[string]*tripGeofences
+}
+
+func newGeofenceTracker() *geofenceTracker {
+	return &geofenceTracker{trips: make(map[string]*tripGeofences)}
+}
+
+type geofenceEvent struct {
+	name   string
+	target geofenceTarget
+}
+
+// Evaluate checks fix against the trip's targets and emits an event for
+// every zone change.
+func (g *geofenceTracker) Evaluate(ctx context.Context, fix driverFix) {
+	g.mu.Lock()
+	state, ok := g.trips[fix.tripID]
+	if !ok {
+		state = &tripGeofences{zones: make(map[string]geofenceZone)}
+		g.trips[fix.tripID] = state
+	}
+	var tracked []string
+	for key, zone := range state.zones {
+		if zone != zoneOutside {
+			tracked = append(tracked, key)
+		}
+	}
+	g.mu.Unlock()
+
+	targets, err := geofenceTargets(ctx, fix.tripID, fix.payload.Lat, fix.payload.Lng, cfg.GeofenceApproachM, tracked)
+	if err != nil {
+		log.Printf("geofence query failed for trip %s: %v", fix.tripID, err)
+		return
+	}
+
+	g.mu.Lock()
+	current := make(map[string]bool, len(targets))
+	var events []geofenceEvent
+	for _, t := range targets {
+		current[t.key()] = true
+		next, name := nextGeofenceZone(state.zones[t.key()], t.distanceM)
+		state.zones[t.key()] = next
+		if name != "" {
+			events = append(events, geofenceEvent{name: name, target: t})
+		}
+	}
+	// A tracked target that is no longer returned changed status (the rider
+	// boarded, was dropped off or cancelled) and is forgotten silently.
+	for _, key := range tracked {
+		if !current[key] {
+			delete(state.zones, key)
+		}
+	}
+	driverUserID := state.driverUserID
+	g.mu.Unlock()
+
+	if len(events) == 0 {
+		return
+	}
+	if driverUserID == "" {
+		if driverUserID, err = getTripDriverUserID(ctx, fix.tripID); err != nil {
+			log.Printf("geofence: driver lookup failed for trip %s: %v", fix.tripID, err)
+			return
+		}
+		g.mu.Lock()
+		state.driverUserID = driverUserID
+		g.mu.Unlock()
+	}
+	for _, ev := range events {
+		emitGeofenceEvent(fix, driverUserID, ev)
+	}
+}
+
+// Forget drops the state of a trip that has ended.
+func (g *geofenceTracker) Forget(tripID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.trips, tripID)
+}
+
+// nextGeofenceZone applies one distance sample to a zone and names the event
+// the transition raises, if any.
+func nextGeofenceZone(zone geofenceZone, distanceM float64) (geofenceZone, string) {
+	arrive := cfg.GeofenceArriveM
+	approach := cfg.GeofenceApproachM
+	margin := cfg.GeofenceHysteresisM
+
+	switch zone {
+	case zoneOutside:
+		if distanceM <= arrive {
+			return zoneArrived, "driver_arrived"
+		}
+		if distanceM <= approach {
+			return zoneApproaching, "driver_approaching"
+		}
+	case zoneApproaching:
+		if distanceM <= arrive {
+			return zoneArrived, "driver_arrived"
+		}
+		if distanceM > approach+margin {
+			return zoneOutside, ""
+		}
+	case zoneArrived:
+		if distanceM > arrive+margin {
+			return zoneDeparted, "driver_departed"
+		}
+	case zoneDeparted:
+		if distanceM <= arrive {
+			return zoneArrived, "driver_arrived"
+		}
+	}
+	return zone, ""
+}
+
+// emitGeofenceEvent sends pickup and drop events to the rider concerned and
+// the driver. Stops concern everyone on board and go to the whole room, and
+// arriving at or leaving one is recorded on trip_stops.
+func emitGeofenceEvent(fix driverFix, driverUserID string, ev geofenceEvent) {
+	t := ev.target
+	payload := GeofenceEventPayload{
+		TripID:    fix.tripID,
+		Target:    t.kind,
+		Address:   t.address,
+		DistanceM: math.Round(t.distanceM),
+		At:        fix.receivedAt.UTC().Format(time.RFC3339),
+	}
+	if t.kind == "stop" {
+		payload.StopID = t.id
+	} else {
+		payload.RequestID = t.id
+	}
+
+	msg := SocketResponse{Event: ev.name, Payload: payload}
+	if t.kind == "stop" {
+		hub.BroadcastToTrip(fix.tripID, msg)
+		recordStopVisit(fix, ev)
+		return
+	}
+	hub.SendToTripUsers(fix.tripID, []string{t.riderUserID, driverUserID}, msg)
+}
+
+// recordStopVisit persists a stop arrival or departure and announces the
+// first one of each, plus any stops the arrival skipped.
+func recordStopVisit(fix driverFix, ev geofenceEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	switch ev.name {
+	case "driver_arrived":
+		stop, skipped, ok, err := markStopArrived(ctx, fix.tripID, ev.target.id, fix.receivedAt)
+		if err != nil {
+			log.Printf("recording arrival at stop %s of trip %s failed: %v", ev.target.id, fix.tripID, err)
+			return
+		}
+		if !ok {
+			return
+		}
+		for _, s := range skipped {
+			hub.BroadcastToTrip(fix.tripID, SocketResponse{Event: "stop_skipped", Payload: s})
+		}
+		hub.BroadcastToTrip(fix.tripID, SocketResponse{Event: "stop_arrived", Payload: stop})
+	case "driver_departed":
+		stop, ok, err := markStopDeparted(ctx, fix.tripID, ev.target.id, fix.receivedAt)
+		if err != nil {
+			log.Printf("recording departure from stop %s of trip %s failed: %v", ev.target.id, fix.tripID, err)
+			return
+		}
+		if ok {
+			hub.BroadcastToTrip(fix.tripID, SocketResponse{Event: "stop_departed", Payload: stop})
+		}
+	}
+}
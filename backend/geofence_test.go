@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+// TestGeofenceZoneWalk drives one target through a pickup the way a driver
+// would: in from afar, wobbling at each boundary, away and back again.
+func TestGeofenceZoneWalk(t *testing.T) {
+	useDefaultConfig(t)
+	cfg.GeofenceApproachM = 500
+	cfg.GeofenceArriveM = 50
+	cfg.GeofenceHysteresisM = 30
+
+	walk := []struct {
+		distanceM float64
+		zone      geofenceZone
+		event     string
+	}{
+		{800, zoneOutside, ""},
+		{500, zoneApproaching, "driver_approaching"},
+		{520, zoneApproaching, ""}, // inside the margin
+		{531, zoneOutside, ""},
+		{490, zoneApproaching, "driver_approaching"},
+		{50, zoneArrived, "driver_arrived"},
+		{79, zoneArrived, ""},
+		{80, zoneArrived, ""}, // exactly arrive plus margin
+		{40, zoneArrived, ""},
+		{81, zoneDeparted, "driver_departed"},
+		{300, zoneDeparted, ""}, // no second approach
+		{900, zoneDeparted, ""},
+		{45, zoneArrived, "driver_arrived"},
+	}
+	zone := zoneOutside
+	for i, step := range walk {
+		var event string
+		zone, event = nextGeofenceZone(zone, step.distanceM)
+		if zone != step.zone || event != step.event {
+			t.Fatalf("step %d at %vm: got (%v, %q), want (%v, %q)", i, step.distanceM, zone, event, step.zone, step.event)
+		}
+	}
+}
+
+func TestGeofenceZoneArrivesWithoutApproaching(t *testing.T) {
+	useDefaultConfig(t)
+	cfg.GeofenceApproachM = 500
+	cfg.GeofenceArriveM = 50
+
+	// A driver who first reports from inside the arrive radius, e.g. after
+	// a reconnect, arrives without an approach event.
+	if zone, event := nextGeofenceZone(zoneOutside, 40); zone != zoneArrived || event != "driver_arrived" {
+		t.Errorf("got (%v, %q), want arrived", zone, event)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Every position a driver or rider reports passes through a filter kept on
+// the trip room before it is broadcast or persisted. Fixes that imply a jump
+// faster than GPSMaxSpeedKmph are dropped; the rest are blended into the
+// running estimate by a simple Kalman filter: the estimate is carried
+// forward along the smoothed heading and speed, its uncertainty grows with
+// the time since the last fix, and each fix pulls it back in proportion.
+// Heading and speed are smoothed exponentially.
+
+const (
+	gpsProcessNoiseMps   = 3.0
+	gpsResetAfter        = 2 * time.Minute
+	gpsReseedAfter       = 3
+	gpsSmoothing         = 0.3
+	gpsMinHeadingKmph    = 3.0
+	gpsMaxPredictSeconds = 10
+)
+
+type positionFilter struct {
+	seeded   bool
+	lat, lng float64
+	variance float64
+	at       time.Time
+
+	headingSin, headingCos float64
+	hasHeading             bool
+	speedKmph              float64
+	hasSpeed               bool
+
+	// Consecutive rejected fixes that agree with each other. The estimate
+	// is the one in error when enough of them pile up.
+	rejects   int
+	rejectLat float64
+	rejectLng float64
+	rejectAt  time.Time
+}
+
+type roomFilters struct {
+	mu    sync.Mutex
+	fixes map[string]*positionFilter
+}
+
+// FilterFix runs p through the filter of source (the driver, or one rider)
+// in the trip room. It returns the smoothed fix, or false when p is
+// rejected as an impossible jump.
+func (h *Hub) FilterFix(tripID, source string, p LocationUpdatePayload, at time.Time) (LocationUpdatePayload, bool) {
+	h.mu.Lock()
+	room, ok := h.filters[tripID]
+	if !ok {
+		room = &roomFilters{fixes: make(map[string]*positionFilter)}
+		h.filters[tripID] = room
+	}
+	h.mu.Unlock()
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	f, ok := room.fixes[source]
+	if !ok {
+		f = &positionFilter{}
+		room.fixes[source] = f
+	}
+	return f.apply(p, at)
+}
+
+// ForgetFilter drops the filter of one source, e.g. a rider who got off.
+func (h *Hub) ForgetFilter(tripID, source string) {
+	h.mu.Lock()
+	room, ok := h.filters[tripID]
+	h.mu.Unlock()
+	if !ok {
+		return
+	}
+	room.mu.Lock()
+	delete(room.fixes, source)
+	room.mu.Unlock()
+}
+
+func (f *positionFilter) apply(p LocationUpdatePayload, at time.Time) (LocationUpdatePayload, bool) {
+	if !f.seeded || at.Sub(f.at) > gpsResetAfter {
+		f.seed(p, at)
+		return f.output(p), true
+	}
+
+	dt := max(at.Sub(f.at).Seconds(), 0.001)
+	if !plausibleJump(f.lat, f.lng, p.Lat, p.Lng, dt) {
+		if f.rejects > 0 && plausibleJump(f.rejectLat, f.rejectLng, p.Lat, p.Lng, max(at.Sub(f.rejectAt).Seconds(), 0.001)) {
+			f.rejects++
+		} else {
+			f.rejects = 1
+		}
+		f.rejectLat, f.rejectLng, f.rejectAt = p.Lat, p.Lng, at
+		if f.rejects < gpsReseedAfter {
+			return p, false
+		}
+		f.seed(p, at)
+		return f.output(p), true
+	}
+	f.rejects = 0
+
+	f.predict(dt)
+	f.variance += dt * gpsProcessNoiseMps * gpsProcessNoiseMps
+	gain := f.variance / (f.variance + cfg.GPSAccuracyM*cfg.GPSAccuracyM)
+	f.lat += gain * (p.Lat - f.lat)
+	f.lng += gain * (p.Lng - f.lng)
+	f.variance *= 1 - gain
+	f.at = at
+
+	if p.SpeedKmph != nil && validSpeed(*p.SpeedKmph) {
+		f.speedKmph = f.speedKmph*(1-gpsSmoothing) + *p.SpeedKmph*gpsSmoothing
+		f.hasSpeed = true
+	}
+	// A heading reported while standing still is noise.
+	if p.Heading != nil && validHeading(*p.Heading) && (!f.hasSpeed || f.speedKmph >= gpsMinHeadingKmph) {
+		rad := *p.Heading * math.Pi / 180
+		if f.hasHeading {
+			f.headingSin = f.headingSin*(1-gpsSmoothing) + math.Sin(rad)*gpsSmoothing
+			f.headingCos = f.headingCos*(1-gpsSmoothing) + math.Cos(rad)*gpsSmoothing
+		} else {
+			f.headingSin, f.headingCos, f.hasHeading = math.Sin(rad), math.Cos(rad), true
+		}
+	}
+	return f.output(p), true
+}
+
+// predict moves the estimate along the smoothed heading at the smoothed
+// speed, so the filter does not trail a moving vehicle.
+func (f *positionFilter) predict(dt float64) {
+	if !f.hasSpeed || !f.hasHeading || dt > gpsMaxPredictSeconds {
+		return
+	}
+	d := f.speedKmph / 3.6 * dt
+	bearing := math.Atan2(f.headingSin, f.headingCos)
+	f.lat += d * math.Cos(bearing) / earthRadiusM * 180 / math.Pi
+	f.lng += d * math.Sin(bearing) / (earthRadiusM * math.Cos(f.lat*math.Pi/180)) * 180 / math.Pi
+}
+
+func (f *positionFilter) seed(p LocationUpdatePayload, at time.Time) {
+	*f = positionFilter{
+		seeded:   true,
+		lat:      p.Lat,
+		lng:      p.Lng,
+		variance: cfg.GPSAccuracyM * cfg.GPSAccuracyM,
+		at:       at,
+	}
+	if p.SpeedKmph != nil && validSpeed(*p.SpeedKmph) {
+		f.speedKmph, f.hasSpeed = *p.SpeedKmph, true
+	}
+	if p.Heading != nil && validHeading(*p.Heading) {
+		rad := *p.Heading * math.Pi / 180
+		f.headingSin, f.headingCos, f.hasHeading = math.Sin(rad), math.Cos(rad), true
+	}
+}
+
+// output is p with the filtered position. Heading and speed are only sent
+// when the client sent them.
+func (f *positionFilter) output(p LocationUpdatePayload) LocationUpdatePayload {
+	out := LocationUpdatePayload{TripID: p.TripID, Lat: f.lat, Lng: f.lng}
+	if p.Heading != nil && f.hasHeading {
+		h := math.Mod(math.Atan2(f.headingSin, f.headingCos)*180/math.Pi+360, 360)
+		out.Heading = &h
+	}
+	if p.SpeedKmph != nil && f.hasSpeed {
+		s := f.speedKmph
+		out.SpeedKmph = &s
+	}
+	return out
+}
+
+// plausibleJump allows for the fastest credible travel in dt plus the error
+// of both fixes.
+func plausibleJump(lat1, lng1, lat2, lng2, dt float64) bool {
+	limit := cfg.GPSMaxSpeedKmph/3.6*dt + 2*cfg.GPSAccuracyM
+	return haversineMeters(lat1, lng1, lat2, lng2) <= limit
+}
+
+func validHeading(h float64) bool {
+	return !math.IsNaN(h) && !math.IsInf(h, 0) && h >= 0 && h <= 360
+}
+
+func validSpeed(s float64) bool {
+	return !math.IsNaN(s) && !math.IsInf(s, 0) && s >= 0 && s <= cfg.GPSMaxSpeedKmph
+}
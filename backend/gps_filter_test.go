@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var gpsTestStart = time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+
+// feed applies a fix at lat (lng fixed) seconds after gpsTestStart.
+func feed(f *positionFilter, seconds float64, lat float64) (LocationUpdatePayload, bool) {
+	at := gpsTestStart.Add(time.Duration(seconds * float64(time.Second)))
+	return f.apply(LocationUpdatePayload{TripID: "t1", Lat: lat, Lng: 77.59}, at)
+}
+
+func TestPositionFilterRejectsImpossibleJump(t *testing.T) {
+	useDefaultConfig(t)
+	cfg.GPSMaxSpeedKmph = 160
+	f := &positionFilter{}
+
+	if out, ok := feed(f, 0, 12.97); !ok || out.Lat != 12.97 {
+		t.Fatalf("first fix = (%v, %v), want it to seed the filter as is", out.Lat, ok)
+	}
+	// 11 km in a second.
+	if _, ok := feed(f, 1, 13.07); ok {
+		t.Error("jump accepted")
+	}
+	// After a long enough gap the same place is reachable again.
+	if _, ok := feed(f, 1+gpsResetAfter.Seconds(), 13.07); !ok {
+		t.Error("fix after a long gap rejected")
+	}
+}
+
+func TestPositionFilterReseedsOnAgreeingRejects(t *testing.T) {
+	useDefaultConfig(t)
+	cfg.GPSMaxSpeedKmph = 160
+	f := &positionFilter{}
+	feed(f, 0, 12.97)
+
+	// The estimate was the one in error: the phone keeps reporting the
+	// same far-off place, and the third such fix moves the filter there.
+	for i, lat := range []float64{13.07, 13.0701} {
+		if _, ok := feed(f, float64(i+1), lat); ok {
+			t.Fatalf("reject %d accepted", i+1)
+		}
+	}
+	out, ok := feed(f, 3, 13.0702)
+	if !ok {
+		t.Fatal("third agreeing fix rejected")
+	}
+	if d := haversineMeters(out.Lat, out.Lng, 13.0702, 77.59); d > 1 {
+		t.Errorf("reseeded %.0fm away from the fix", d)
+	}
+	if _, ok := feed(f, 4, 13.0703); !ok {
+		t.Error("fix next to the new seed rejected")
+	}
+}
+
+func TestPositionFilterRejectCountResets(t *testing.T) {
+	useDefaultConfig(t)
+	cfg.GPSMaxSpeedKmph = 160
+
+	// Rejects that disagree with each other start the count over.
+	f := &positionFilter{}
+	feed(f, 0, 12.97)
+	for i, lat := range []float64{13.07, 12.87, 13.07} {
+		if _, ok := feed(f, float64(i+1), lat); ok {
+			t.Errorf("disagreeing reject %d accepted", i+1)
+		}
+	}
+
+	// So does an accepted fix in between.
+	f = &positionFilter{}
+	feed(f, 0, 12.97)
+	feed(f, 1, 13.07)
+	feed(f, 2, 13.0701)
+	if _, ok := feed(f, 3, 12.9701); !ok {
+		t.Fatal("plausible fix rejected")
+	}
+	if _, ok := feed(f, 4, 13.0702); ok {
+		t.Error("reject after an accepted fix reseeded the filter")
+	}
+}
+
+func TestPositionFilterSmoothsTowardsFix(t *testing.T) {
+	useDefaultConfig(t)
+	f := &positionFilter{}
+	feed(f, 0, 12.97)
+
+	out, ok := feed(f, 1, 12.9702)
+	if !ok {
+		t.Fatal("plausible fix rejected")
+	}
+	if out.Lat <= 12.97 || out.Lat >= 12.9702 {
+		t.Errorf("lat = %v, want strictly between the estimate and the fix", out.Lat)
+	}
+	if out.Lng != 77.59 {
+		t.Errorf("lng = %v, want 77.59 unchanged", out.Lng)
+	}
+}
@@ -2,10 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"net/url"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,7 +26,10 @@ func setupRoutes() {
 	http.HandleFunc("/api/trips/", tripsAPIHandler)
 	http.HandleFunc("/api/requests/", requestsAPIHandler)
 	http.HandleFunc("/api/live/trips/", liveTripViewAPIHandler)
+	http.HandleFunc("/api/live/shares/", liveShareAPIHandler)
 	http.HandleFunc("/api/live/driver/current", liveDriverCurrentTripAPIHandler)
+	http.HandleFunc("/api/incidents/", incidentsAPIHandler)
+	http.HandleFunc("/api/ws/catalog", wsCatalogAPIHandler)
 }
 
 func tripsAPIHandler(w http.ResponseWriter, r *http.Request) {
@@ -164,6 +173,26 @@ func liveTripViewAPIHandler(w http.ResponseWriter, r *http.Request) {
 	if !handleCORS(w, r) {
 		return
 	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/live/trips/")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) == 2 && parts[1] == "share" {
+		liveTripShareCreateHandler(w, r, parts[0])
+		return
+	}
+	if len(parts) == 2 && parts[1] == "messages" {
+		liveTripMessagesHandler(w, r, parts[0])
+		return
+	}
+	if len(parts) == 2 && parts[1] == "trace" {
+		liveTripTraceHandler(w, r, parts[0])
+		return
+	}
+	if len(parts) == 2 && parts[1] == "sos" {
+		liveTripSOSHandler(w, r, parts[0])
+		return
+	}
+
 	if r.Method != http.MethodGet {
 		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"success": false, "message": "method not allowed"})
 		return
@@ -175,9 +204,8 @@ func liveTripViewAPIHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	path := strings.TrimPrefix(r.URL.Path, "/api/live/trips/")
-	tripID := strings.Trim(path, "/")
-	if tripID == "" {
+	tripID := parts[0]
+	if len(parts) != 1 || tripID == "" {
 		writeJSON(w, http.StatusNotFound, map[string]interface{}{"success": false, "message": "invalid trip id"})
 		return
 	}
@@ -202,6 +230,304 @@ func liveTripViewAPIHandler(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "trip": trip})
 }
 
+const (
+	shareLinkDefaultTTL = 4 * time.Hour
+	shareLinkMaxTTL     = 24 * time.Hour
+)
+
+// liveTripShareCreateHandler mints a read-only share link for a trip the
+// caller is driving or riding in. The caller may shorten the default
+// lifetime with ?ttlMinutes=.
+func liveTripShareCreateHandler(w http.ResponseWriter, r *http.Request, tripID string) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"success": false, "message": "method not allowed"})
+		return
+	}
+
+	userID, err := verifyToken(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"success": false, "message": "unauthorized"})
+		return
+	}
+
+	ttl := shareLinkDefaultTTL
+	if raw := r.URL.Query().Get("ttlMinutes"); raw != "" {
+		minutes, err := strconv.Atoi(raw)
+		if err != nil || minutes <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"success": false, "message": "invalid ttlMinutes"})
+			return
+		}
+		ttl = time.Duration(minutes) * time.Minute
+		if ttl > shareLinkMaxTTL {
+			ttl = shareLinkMaxTTL
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	if !isDriverForTrip(ctx, tripID, userID) && !isRiderForTrip(ctx, tripID, userID) {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"success": false, "message": "forbidden"})
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl).UTC()
+	shareID, err := createTripShareLink(ctx, tripID, userID, expiresAt)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"success": false, "message": "failed to create share link"})
+		return
+	}
+	token, err := signShareToken(shareID, tripID, expiresAt)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"success": false, "message": "failed to create share link"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"shareId":   shareID,
+		"token":     token,
+		"expiresAt": expiresAt.Format(time.RFC3339),
+	})
+}
+
+const (
+	chatPageDefault = 50
+	chatPageMax     = 200
+)
+
+// liveTripMessagesHandler pages through a trip's chat, newest page first
+// and oldest message first within a page. Pass the returned nextBefore as
+// ?before= to fetch the page before it. History stays readable after the
+// trip ends, until the retention purge removes it.
+func liveTripMessagesHandler(w http.ResponseWriter, r *http.Request, tripID string) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"success": false, "message": "method not allowed"})
+		return
+	}
+
+	userID, err := verifyToken(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"success": false, "message": "unauthorized"})
+		return
+	}
+
+	limit := chatPageDefault
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"success": false, "message": "invalid limit"})
+			return
+		}
+		limit = min(n, chatPageMax)
+	}
+	before := r.URL.Query().Get("before")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	if !isTripParticipant(ctx, tripID, userID) {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"success": false, "message": "forbidden"})
+		return
+	}
+
+	messages, err := getTripMessages(ctx, tripID, userID, before, limit)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"success": false, "message": "failed to fetch messages"})
+		return
+	}
+
+	nextBefore := ""
+	if len(messages) == limit {
+		nextBefore = messages[len(messages)-1].MessageID
+	}
+	slices.Reverse(messages)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "messages": messages, "nextBefore": nextBefore})
+}
+
+// liveTripTraceHandler exports the breadcrumb trail of a trip the caller
+// drove or rode in, as ?format=geojson (default), gpx or kml.
+func liveTripTraceHandler(w http.ResponseWriter, r *http.Request, tripID string) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"success": false, "message": "method not allowed"})
+		return
+	}
+
+	userID, err := verifyToken(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"success": false, "message": "unauthorized"})
+		return
+	}
+
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		format = "geojson"
+	}
+	exporter, ok := traceFormats[format]
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"success": false, "message": "format must be geojson, gpx or kml"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+
+	if !isTripParticipant(ctx, tripID, userID) {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"success": false, "message": "forbidden"})
+		return
+	}
+
+	// Breadcrumbs still buffered for an ongoing trip belong in the export.
+	if err := liveLocations.FlushTrip(ctx, tripID); err != nil {
+		log.Printf("trace export: flush for trip %s failed: %v", tripID, err)
+	}
+	points, err := getTripTrace(ctx, tripID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"success": false, "message": "failed to fetch trace"})
+		return
+	}
+
+	w.Header().Set("Content-Type", exporter.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="trip-%s.%s"`, tripID, format))
+	w.WriteHeader(http.StatusOK)
+	if err := exporter.encode(w, tripID, points); err != nil {
+		log.Printf("trace export for trip %s failed: %v", tripID, err)
+	}
+}
+
+// liveTripSOSHandler is the HTTP fallback for the sos socket event, for
+// clients whose socket is down. The body may carry note, lat and lng.
+func liveTripSOSHandler(w http.ResponseWriter, r *http.Request, tripID string) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"success": false, "message": "method not allowed"})
+		return
+	}
+
+	userID, err := verifyToken(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"success": false, "message": "unauthorized"})
+		return
+	}
+
+	payload := SOSPayload{TripID: tripID}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxMessageSize)).Decode(&payload); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"success": false, "message": "invalid body"})
+			return
+		}
+		payload.TripID = tripID
+	}
+	if err := payload.validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"success": false, "message": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	role := ""
+	if isDriverForTrip(ctx, tripID, userID) {
+		role = "driver"
+	} else if isRiderForTrip(ctx, tripID, userID) {
+		role = "rider"
+	} else {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"success": false, "message": "forbidden"})
+		return
+	}
+
+	inc, err := raiseSOS(ctx, tripID, userID, role, payload.Note, payload.Lat, payload.Lng)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"success": false, "message": "failed to raise SOS"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "incident": inc.alertPayload()})
+}
+
+// incidentsAPIHandler serves POST /api/incidents/{id}/ack for operators. It
+// is called server to server and authenticated with SOS_OPS_TOKEN in the
+// X-Ops-Token header rather than a user session. The body may name who
+// acknowledged it in "by".
+func incidentsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"success": false, "message": "method not allowed"})
+		return
+	}
+
+	opsToken := os.Getenv("SOS_OPS_TOKEN")
+	given := r.Header.Get("X-Ops-Token")
+	if opsToken == "" || subtle.ConstantTimeCompare([]byte(given), []byte(opsToken)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"success": false, "message": "unauthorized"})
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/incidents/")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "ack" {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"success": false, "message": "not found"})
+		return
+	}
+
+	var body struct {
+		By string `json:"by"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxMessageSize)).Decode(&body); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"success": false, "message": "invalid body"})
+			return
+		}
+	}
+	if body.By = strings.TrimSpace(body.By); body.By == "" {
+		body.By = "operator"
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	if err := acknowledgeSOS(ctx, parts[0], body.By); err != nil {
+		if err == pgx.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"success": false, "message": "no open incident with that id"})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"success": false, "message": "failed to acknowledge incident"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+func liveShareAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if !handleCORS(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"success": false, "message": "method not allowed"})
+		return
+	}
+
+	userID, err := verifyToken(r)
+	if err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"success": false, "message": "unauthorized"})
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/live/shares/")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 2 || parts[1] != "revoke" {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"success": false, "message": "invalid share action path"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 8*time.Second)
+	defer cancel()
+
+	tripID, ok := revokeTripShareLink(ctx, parts[0], userID)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"success": false, "message": "Share link not found"})
+		return
+	}
+	hub.RevokeShare(tripID, parts[0])
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Share link revoked"})
+}
+
 func liveDriverCurrentTripAPIHandler(w http.ResponseWriter, r *http.Request) {
 	if !handleCORS(w, r) {
 		return
@@ -232,3 +558,14 @@ func liveDriverCurrentTripAPIHandler(w http.ResponseWriter, r *http.Request) {
 
 	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "trip": trip})
 }
+
+func wsCatalogAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if !handleCORS(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"success": false, "message": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, wsCatalog())
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -56,3 +57,60 @@ func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
 	w.WriteHeader(status)
 	_ = json.NewEncoder(w).Encode(payload)
 }
+
+type shareClaims struct {
+	ShareID string
+	TripID  string
+}
+
+// Share link tokens are signed with a key derived from JWT_SECRET so they can
+// never be mistaken for a session token by verifyToken.
+func shareSigningKey() ([]byte, error) {
+	jwtSecret := os.Getenv("JWT_SECRET")
+	if jwtSecret == "" {
+		return nil, fmt.Errorf("JWT_SECRET not configured")
+	}
+	return []byte("trip-share:" + jwtSecret), nil
+}
+
+func signShareToken(shareID, tripID string, expiresAt time.Time) (string, error) {
+	key, err := shareSigningKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sid":    shareID,
+		"tripId": tripID,
+		"exp":    expiresAt.Unix(),
+	})
+	return token.SignedString(key)
+}
+
+func verifyShareToken(tokenString string) (*shareClaims, error) {
+	key, err := shareSigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
+		_, ok := t.Method.(*jwt.SigningMethodHMAC)
+		if !ok {
+			return nil, fmt.Errorf("wrong signing method: %v", t.Header["alg"])
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify share token: %v", err)
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("share token is invalid")
+	}
+	shareID, _ := claims["sid"].(string)
+	tripID, _ := claims["tripId"].(string)
+	if shareID == "" || tripID == "" {
+		return nil, fmt.Errorf("share token is invalid")
+	}
+	return &shareClaims{ShareID: shareID, TripID: tripID}, nil
+}
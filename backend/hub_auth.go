@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// tripAuth is what a client was authorized as when it joined a room. It is
+// cached on the subscription so the location hot path does not go back to
+// the database. Lifecycle changes mark it stale, and it also expires after
+// AuthCacheTTL to pick up changes made outside this server.
+type tripAuth struct {
+	Role      string
+	DriverID  string
+	RequestID string
+	Name      string
+
+	checkedAt time.Time
+	stale     bool
+}
+
+// authorizeTrip resolves what the client may join a trip room as.
+func (c *Client) authorizeTrip(ctx context.Context, tripID string) (tripAuth, bool) {
+	if c.shareID != "" {
+		if tripID == c.shareTripID && isTripShareLinkActive(ctx, c.shareID, tripID) {
+			return tripAuth{Role: "spectator", checkedAt: time.Now()}, true
+		}
+		return tripAuth{}, false
+	}
+
+	auth, err := resolveTripAuth(ctx, tripID, c.userID)
+	if err != nil {
+		return tripAuth{}, false
+	}
+	auth.checkedAt = time.Now()
+	return auth, true
+}
+
+// currentAuth returns the cached authorization for a room the client has
+// joined, re-resolving it when stale. A client that is no longer allowed in
+// the room is removed from it.
+func (c *Client) currentAuth(ctx context.Context, tripID string) (tripAuth, bool) {
+	auth, joined := hub.cachedAuth(c, tripID)
+	if !joined {
+		return tripAuth{}, false
+	}
+	if !auth.stale && time.Since(auth.checkedAt) < cfg.AuthCacheTTL {
+		return auth, true
+	}
+
+	fresh, ok := c.authorizeTrip(ctx, tripID)
+	if !ok || fresh.Role != auth.Role {
+		hub.LeaveRoom(c, tripID)
+		return tripAuth{}, false
+	}
+	hub.refreshAuth(c, tripID, fresh)
+	return fresh, true
+}
+
+func (h *Hub) cachedAuth(c *Client, tripID string) (tripAuth, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	auth, ok := c.subscriptions[tripID]
+	if !ok {
+		return tripAuth{}, false
+	}
+	return *auth, true
+}
+
+func (h *Hub) refreshAuth(c *Client, tripID string, auth tripAuth) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := c.subscriptions[tripID]; ok {
+		c.subscriptions[tripID] = &auth
+	}
+}
+
+// InvalidateAuth marks cached authorizations in a room stale, for one user
+// or for everyone when userID is empty, on every instance.
+func (h *Hub) InvalidateAuth(tripID, userID string) {
+	h.invalidateAuthLocal(tripID, userID)
+	h.publish(hubNotification{Kind: "invalidate_auth", TripID: tripID, UserID: userID})
+}
+
+func (h *Hub) invalidateAuthLocal(tripID, userID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.rooms[tripID] {
+		if userID != "" && c.userID != userID {
+			continue
+		}
+		if auth, ok := c.subscriptions[tripID]; ok {
+			auth.stale = true
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Presence is tracked per user rather than per connection: a user is online
+// in a room while they have at least one connection in it on any instance.
+// Each instance counts its own connections and learns about the others from
+// presence notifications, so every instance derives the same joined/left
+// transitions and only delivers them to its local clients. Spectators are
+// not participants and are never tracked.
+//
+// Every instance also sends its whole local roster as a heartbeat, and when
+// it starts listening it asks the others for theirs. A heartbeat replaces
+// what was known about its sender, and the users of an instance that has
+// not been heard from within presenceTTL are taken offline, so a crashed
+// instance does not leave its users online forever.
+
+const (
+	presenceHeartbeat = 10 * time.Second
+	presenceTTL       = 3 * presenceHeartbeat
+)
+
+type presenceRecord struct {
+	TripID string `json:"tripId"`
+	UserID string `json:"userId"`
+	Role   string `json:"role"`
+}
+
+type presenceEntry struct {
+	role   string
+	local  int
+	remote map[string]bool
+}
+
+func (e *presenceEntry) online() bool {
+	return e.local > 0 || len(e.remote) > 0
+}
+
+type PresenceParticipant struct {
+	UserID string `json:"userId"`
+	Role   string `json:"role"`
+}
+
+func (h *Hub) presenceEntryLocked(tripID, userID, role string) *presenceEntry {
+	room, ok := h.presence[tripID]
+	if !ok {
+		room = make(map[string]*presenceEntry)
+		h.presence[tripID] = room
+	}
+	e, ok := room[userID]
+	if !ok {
+		e = &presenceEntry{role: role, remote: make(map[string]bool)}
+		room[userID] = e
+	}
+	return e
+}
+
+// trackPresenceLocked applies a local connection joining (+1) or leaving
+// (-1) a room.
+func (h *Hub) trackPresenceLocked(tripID, userID, role string, delta int) {
+	if role == "spectator" || userID == "" {
+		return
+	}
+
+	e := h.presenceEntryLocked(tripID, userID, role)
+	wasOnline := e.online()
+	wasLocal := e.local > 0
+	e.local += delta
+	if e.local < 0 {
+		e.local = 0
+	}
+
+	if wasLocal != (e.local > 0) {
+		h.publish(hubNotification{Kind: "presence", TripID: tripID, UserID: userID, Role: role, Online: e.local > 0})
+	}
+	h.presenceChangedLocked(tripID, userID, e, wasOnline)
+}
+
+func (h *Hub) remotePresence(origin, tripID, userID, role string, online bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e := h.presenceEntryLocked(tripID, userID, role)
+	wasOnline := e.online()
+	if online {
+		e.remote[origin] = true
+	} else {
+		delete(e.remote, origin)
+	}
+	h.presenceChangedLocked(tripID, userID, e, wasOnline)
+}
+
+// publishPresence sends the local roster of every room. It is queued under
+// the lock so it stays in order with individual presence notifications.
+func (h *Hub) publishPresence() {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	present := []presenceRecord{}
+	for tripID, room := range h.presence {
+		for userID, e := range room {
+			if e.local > 0 {
+				present = append(present, presenceRecord{TripID: tripID, UserID: userID, Role: e.role})
+			}
+		}
+	}
+	h.publish(hubNotification{Kind: "presence_sync", Present: present})
+}
+
+// syncRemotePresence replaces what is known about origin's users.
+func (h *Hub) syncRemotePresence(origin string, present []presenceRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	listed := make(map[[2]string]bool, len(present))
+	for _, p := range present {
+		listed[[2]string{p.TripID, p.UserID}] = true
+		e := h.presenceEntryLocked(p.TripID, p.UserID, p.Role)
+		wasOnline := e.online()
+		e.remote[origin] = true
+		h.presenceChangedLocked(p.TripID, p.UserID, e, wasOnline)
+	}
+	h.dropRemoteLocked(origin, func(tripID, userID string) bool { return !listed[[2]string{tripID, userID}] })
+}
+
+// dropRemoteLocked takes origin's connections away from the users matched.
+func (h *Hub) dropRemoteLocked(origin string, match func(tripID, userID string) bool) {
+	for tripID, room := range h.presence {
+		for userID, e := range room {
+			if !e.remote[origin] || !match(tripID, userID) {
+				continue
+			}
+			wasOnline := e.online()
+			delete(e.remote, origin)
+			h.presenceChangedLocked(tripID, userID, e, wasOnline)
+		}
+	}
+}
+
+func (h *Hub) peerSeen(origin string) {
+	h.mu.Lock()
+	h.presenceSeen[origin] = time.Now()
+	h.mu.Unlock()
+}
+
+// expirePeers drops the users of instances that have gone quiet.
+func (h *Hub) expirePeers(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for origin, seen := range h.presenceSeen {
+		if now.Sub(seen) <= presenceTTL {
+			continue
+		}
+		log.Printf("hub instance %s silent since %s, dropping its presence", origin, seen.Format(time.RFC3339))
+		delete(h.presenceSeen, origin)
+		h.dropRemoteLocked(origin, func(string, string) bool { return true })
+	}
+}
+
+func (h *Hub) runPresenceHeartbeat(ctx context.Context) {
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.publishPresence()
+			h.expirePeers(now)
+		}
+	}
+}
+
+func (h *Hub) presenceChangedLocked(tripID, userID string, e *presenceEntry, wasOnline bool) {
+	online := e.online()
+	if !online {
+		delete(h.presence[tripID], userID)
+		if len(h.presence[tripID]) == 0 {
+			delete(h.presence, tripID)
+		}
+	}
+	if online == wasOnline {
+		return
+	}
+
+	event := "participant_left"
+	if online {
+		event = "participant_joined"
+	}
+	payload, err := json.Marshal(PresenceEventPayload{TripID: tripID, UserID: userID, Role: e.role})
+	if err != nil {
+		log.Printf("marshal error for trip %s: %v", tripID, err)
+		return
+	}
+	h.deliverLocalLocked(tripID, audience{}, event, payload)
+}
+
+// Roster lists the users currently online in the room.
+func (h *Hub) Roster(tripID string) []PresenceParticipant {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	roster := make([]PresenceParticipant, 0, len(h.presence[tripID]))
+	for userID, e := range h.presence[tripID] {
+		if e.online() {
+			roster = append(roster, PresenceParticipant{UserID: userID, Role: e.role})
+		}
+	}
+	return roster
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Room traffic is relayed between backend instances over Postgres
+// LISTEN/NOTIFY. Each instance delivers to its own clients immediately and
+// ignores notifications that carry its own instance ID. A message too large
+// for a NOTIFY payload is stored in hub_messages and only its id is sent;
+// peers fetch the body when the id arrives. Stored messages are deleted
+// once every peer has had ample time to read them.
+
+const (
+	hubNotifyChannel   = "yatra_hub"
+	hubOutboxSize      = 1024
+	hubNotifyMaxBytes  = 7900
+	hubListenRetryWait = 2 * time.Second
+	hubMessageTTL      = 5 * time.Minute
+)
+
+type hubNotification struct {
+	Origin  string          `json:"origin"`
+	Kind    string          `json:"kind"`
+	TripID  string          `json:"tripId"`
+	Role    string          `json:"role,omitempty"`
+	Event   string          `json:"event,omitempty"`
+	ShareID string          `json:"shareId,omitempty"`
+	UserID  string          `json:"userId,omitempty"`
+	Users   []string        `json:"users,omitempty"`
+	Online  bool            `json:"online,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	// Present is the full local roster of the origin, sent by presence_sync.
+	Present []presenceRecord `json:"present,omitempty"`
+	// Ref is the hub_messages id of a stored message; nothing else but
+	// Origin is set.
+	Ref int64 `json:"ref,omitempty"`
+}
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+// publish queues n for other instances without blocking the caller.
+func (h *Hub) publish(n hubNotification) {
+	n.Origin = h.instanceID
+	select {
+	case h.outbox <- n:
+	default:
+		log.Printf("hub outbox full, dropping %s for trip %s", n.Kind, n.TripID)
+	}
+}
+
+func (h *Hub) StartPubSub(ctx context.Context) {
+	go h.runPublisher(ctx)
+	go h.runListener(ctx)
+	go h.runPresenceHeartbeat(ctx)
+}
+
+func (h *Hub) runPublisher(ctx context.Context) {
+	cleanup := time.NewTicker(time.Minute)
+	defer cleanup.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-cleanup.C:
+			cleanCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			if _, err := dbPool.Exec(cleanCtx, `DELETE FROM hub_messages WHERE created_at < $1`, time.Now().Add(-hubMessageTTL)); err != nil {
+				log.Printf("hub message cleanup error: %v", err)
+			}
+			cancel()
+		case n := <-h.outbox:
+			body, err := json.Marshal(n)
+			if err != nil {
+				log.Printf("hub notify marshal error: %v", err)
+				continue
+			}
+
+			pubCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+			if len(body) > hubNotifyMaxBytes {
+				body, err = storeHubMessage(pubCtx, h.instanceID, body)
+			}
+			if err == nil {
+				_, err = dbPool.Exec(pubCtx, `SELECT pg_notify($1, $2)`, hubNotifyChannel, string(body))
+			}
+			cancel()
+			if err != nil {
+				log.Printf("hub notify error for trip %s: %v", n.TripID, err)
+			}
+		}
+	}
+}
+
+// storeHubMessage saves an oversized message and returns the notification
+// that points peers at it.
+func storeHubMessage(ctx context.Context, origin string, body []byte) ([]byte, error) {
+	var id int64
+	if err := dbPool.QueryRow(ctx, `INSERT INTO hub_messages (body) VALUES ($1) RETURNING id`, string(body)).Scan(&id); err != nil {
+		return nil, err
+	}
+	return json.Marshal(hubNotification{Origin: origin, Ref: id})
+}
+
+func loadHubMessage(ctx context.Context, id int64) (hubNotification, error) {
+	var body string
+	var n hubNotification
+	if err := dbPool.QueryRow(ctx, `SELECT body FROM hub_messages WHERE id = $1`, id).Scan(&body); err != nil {
+		return n, err
+	}
+	err := json.Unmarshal([]byte(body), &n)
+	return n, err
+}
+
+func (h *Hub) runListener(ctx context.Context) {
+	for {
+		if err := h.listen(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("hub listen error: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(hubListenRetryWait):
+		}
+	}
+}
+
+func (h *Hub) listen(ctx context.Context) error {
+	poolConn, err := dbPool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// The listening connection is taken out of the pool for good so it never
+	// gets handed to a query while still subscribed.
+	conn := poolConn.Hijack()
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		_ = conn.Close(closeCtx)
+		cancel()
+	}()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+hubNotifyChannel); err != nil {
+		return err
+	}
+	log.Printf("Hub %s listening on %s", h.instanceID, hubNotifyChannel)
+	// Anything peers said while this instance was not listening is lost;
+	// ask them for their rosters.
+	h.publish(hubNotification{Kind: "presence_sync_request"})
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var n hubNotification
+		if err := json.Unmarshal([]byte(notification.Payload), &n); err != nil {
+			log.Printf("hub notification decode error: %v", err)
+			continue
+		}
+		if n.Origin == h.instanceID {
+			continue
+		}
+		if ref := n.Ref; ref != 0 {
+			loadCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+			n, err = loadHubMessage(loadCtx, ref)
+			cancel()
+			if err != nil {
+				log.Printf("hub message %d fetch error: %v", ref, err)
+				continue
+			}
+		}
+
+		h.peerSeen(n.Origin)
+		switch n.Kind {
+		case "broadcast":
+			h.deliverLocal(n.TripID, audience{role: n.Role, users: n.Users}, n.Event, n.Data)
+		case "close":
+			h.closeRoomLocal(n.TripID)
+		case "revoke_share":
+			h.revokeShareLocal(n.TripID, n.ShareID)
+		case "invalidate_auth":
+			h.invalidateAuthLocal(n.TripID, n.UserID)
+		case "presence":
+			h.remotePresence(n.Origin, n.TripID, n.UserID, n.Role, n.Online)
+		case "presence_sync":
+			h.syncRemotePresence(n.Origin, n.Present)
+		case "presence_sync_request":
+			h.publishPresence()
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Every message delivered to a room carries a per-room sequence number and
+// is kept in a bounded ring so a client that reconnects can ask for what it
+// missed. Sequence numbers are assigned by the instance delivering them, so
+// the epoch changes whenever a room's history is recreated or the client
+// lands on another instance; a resume across epochs always resyncs.
+
+const (
+	replayBufferSize = 256
+	replayRetention  = 10 * time.Minute
+)
+
+type historyEntry struct {
+	seq   uint64
+	to    audience
+	event string
+	data  []byte
+}
+
+type roomHistory struct {
+	epoch      string
+	seq        uint64
+	entries    []historyEntry
+	next       int
+	lastActive time.Time
+}
+
+func (h *Hub) historyLocked(tripID string) *roomHistory {
+	hist, ok := h.history[tripID]
+	if !ok {
+		hist = &roomHistory{
+			epoch:   fmt.Sprintf("%s-%d", h.instanceID, time.Now().UnixNano()),
+			entries: make([]historyEntry, 0, replayBufferSize),
+		}
+		h.history[tripID] = hist
+	}
+	hist.lastActive = time.Now()
+	return hist
+}
+
+// pruneHistoryLocked drops the history and position filters of rooms
+// nobody has been in or broadcast to for replayRetention.
+func (h *Hub) pruneHistoryLocked(now time.Time) {
+	for tripID, hist := range h.history {
+		if _, active := h.rooms[tripID]; active {
+			continue
+		}
+		if now.Sub(hist.lastActive) > replayRetention {
+			delete(h.history, tripID)
+			delete(h.filters, tripID)
+		}
+	}
+}
+
+func (r *roomHistory) append(e historyEntry) {
+	if len(r.entries) < replayBufferSize {
+		r.entries = append(r.entries, e)
+		return
+	}
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % replayBufferSize
+}
+
+// since returns the entries after lastSeq visible to the user in role,
+// oldest first. ok is false when some of them have already been overwritten.
+func (r *roomHistory) since(lastSeq uint64, role, userID string) ([][]byte, bool) {
+	if lastSeq > r.seq {
+		return nil, false
+	}
+	if lastSeq == r.seq {
+		return nil, true
+	}
+
+	oldest := r.seq - uint64(len(r.entries)) + 1
+	if lastSeq+1 < oldest {
+		return nil, false
+	}
+
+	missed := make([][]byte, 0, r.seq-lastSeq)
+	for i := 0; i < len(r.entries); i++ {
+		e := r.entries[(r.next+i)%len(r.entries)]
+		if e.seq <= lastSeq {
+			continue
+		}
+		if canReceive(role, userID, e.to, e.event) {
+			missed = append(missed, e.data)
+		}
+	}
+	return missed, true
+}
+
+// Resume joins c to the room and queues every message it missed since
+// lastSeq, atomically with respect to new broadcasts. It returns false when
+// the client must resync from the HTTP API instead.
+func (h *Hub) Resume(c *Client, tripID string, auth tripAuth, lastSeq uint64, epoch string) (int, uint64, string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	seq, currentEpoch := h.joinRoomLocked(c, tripID, auth)
+	if epoch != currentEpoch {
+		return 0, seq, currentEpoch, false
+	}
+
+	missed, ok := h.history[tripID].since(lastSeq, auth.Role, c.userID)
+	if !ok {
+		return 0, seq, currentEpoch, false
+	}
+	for _, data := range missed {
+		c.enqueue(data)
+	}
+	return len(missed), seq, currentEpoch, true
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// activeReaders counts reader goroutines so shutdown can wait for their
+// cleanup, which still needs the database pool.
+var activeReaders sync.WaitGroup
+
+// Register admits a new connection unless the hub is draining. Every
+// registered client must be unregistered once its reader cleanup is done.
+func (h *Hub) Register(c *Client) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.draining {
+		return false
+	}
+	h.clients[c] = true
+	activeReaders.Add(1)
+	return true
+}
+
+func (h *Hub) Unregister(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[c] {
+		delete(h.clients, c)
+		activeReaders.Done()
+	}
+}
+
+// Drain stops admitting connections and tells every connected client the
+// server is going away. Each client gets its own reconnect delay so they do
+// not all stampede the next instance at once.
+func (h *Hub) Drain() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.draining = true
+	for c := range h.clients {
+		c.writeJSON(SocketResponse{
+			Event: "server_restarting",
+			Payload: ServerRestartingPayload{
+				ReconnectAfterMs: 1000 + rand.IntN(4000),
+			},
+		})
+	}
+}
+
+// CloseAll disconnects every client and waits, up to ctx, for their reader
+// cleanup to finish.
+func (h *Hub) CloseAll(ctx context.Context) {
+	h.mu.RLock()
+	for c := range h.clients {
+		c.close(websocket.CloseServiceRestart, "server restarting")
+	}
+	h.mu.RUnlock()
+
+	done := make(chan struct{})
+	go func() {
+		activeReaders.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
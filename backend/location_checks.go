@@ -0,0 +1,85 @@
+package main
+
+import "sync"
+
+// fixChecker runs the database-backed checks on driver fixes (route progress
+// and geofences) off the socket reader, after the position has already gone
+// out to the room. Each trip has at most one check running; fixes arriving
+// meanwhile replace one another, so a slow query holds up only that trip and
+// the next run sees the newest position.
+type fixChecker struct {
+	mu    sync.Mutex
+	trips map[string]*checkedTrip
+	check func(fix driverFix)
+	// forget drops whatever per-trip state check keeps. It runs once any
+	// check in flight when the trip was forgotten has returned, so that
+	// check cannot bring the state back.
+	forget func(tripID string)
+}
+
+type checkedTrip struct {
+	pending *driverFix
+	running bool
+}
+
+func newFixChecker(check func(fix driverFix), forget func(tripID string)) *fixChecker {
+	return &fixChecker{
+		trips:  make(map[string]*checkedTrip),
+		check:  check,
+		forget: forget,
+	}
+}
+
+// Submit queues fix as the trip's latest position to check.
+func (fc *fixChecker) Submit(fix driverFix) {
+	fc.mu.Lock()
+	ct, ok := fc.trips[fix.tripID]
+	if !ok {
+		ct = &checkedTrip{}
+		fc.trips[fix.tripID] = ct
+	}
+	ct.pending = &fix
+	if ct.running {
+		fc.mu.Unlock()
+		return
+	}
+	ct.running = true
+	fc.mu.Unlock()
+	go fc.run(fix.tripID, ct)
+}
+
+func (fc *fixChecker) run(tripID string, ct *checkedTrip) {
+	for {
+		fc.mu.Lock()
+		current := fc.trips[tripID] == ct
+		if !current || ct.pending == nil {
+			ct.running = false
+			if current {
+				delete(fc.trips, tripID)
+			}
+			fc.mu.Unlock()
+			if !current {
+				fc.forget(tripID)
+			}
+			return
+		}
+		fix := *ct.pending
+		ct.pending = nil
+		fc.mu.Unlock()
+
+		fc.check(fix)
+	}
+}
+
+// Forget drops any queued fix for a trip that has ended, along with the
+// checks' state for it.
+func (fc *fixChecker) Forget(tripID string) {
+	fc.mu.Lock()
+	ct, ok := fc.trips[tripID]
+	delete(fc.trips, tripID)
+	running := ok && ct.running
+	fc.mu.Unlock()
+	if !running {
+		fc.forget(tripID)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFixCheckerRunsLatestFixOnly(t *testing.T) {
+	release := make(chan struct{})
+	checked := make(chan float64, 8)
+	fc := newFixChecker(func(fix driverFix) {
+		checked <- fix.payload.Lat
+		<-release
+	}, func(string) {})
+
+	fc.Submit(driverFix{tripID: "t1", payload: LocationUpdatePayload{Lat: 1}})
+	if lat := <-checked; lat != 1 {
+		t.Fatalf("first check got %v, want 1", lat)
+	}
+	// While the first check is stuck, two more fixes arrive; only the
+	// newer is checked once it returns.
+	fc.Submit(driverFix{tripID: "t1", payload: LocationUpdatePayload{Lat: 2}})
+	fc.Submit(driverFix{tripID: "t1", payload: LocationUpdatePayload{Lat: 3}})
+	release <- struct{}{}
+	if lat := <-checked; lat != 3 {
+		t.Errorf("second check got %v, want 3", lat)
+	}
+	release <- struct{}{}
+
+	select {
+	case lat := <-checked:
+		t.Errorf("unexpected check of %v", lat)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestFixCheckerForgetWaitsForCheckInFlight(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	forgotten := make(chan string, 1)
+	fc := newFixChecker(func(driverFix) {
+		close(started)
+		<-release
+	}, func(tripID string) { forgotten <- tripID })
+
+	fc.Submit(driverFix{tripID: "t1"})
+	<-started
+	fc.Forget("t1")
+	select {
+	case <-forgotten:
+		t.Fatal("state forgotten while a check could still write it")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case tripID := <-forgotten:
+		if tripID != "t1" {
+			t.Errorf("forgot %q, want t1", tripID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("state never forgotten")
+	}
+}
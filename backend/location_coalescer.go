@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// locationCoalescer accepts driver fixes at whatever rate the phone sends
+// them but persists and broadcasts at most one per flush interval per trip.
+// Fixes that barely moved are held back until the max silence elapses. The
+// newest fix always wins and is flushed once its turn comes, so the last
+// known position is never lost.
+type locationCoalescer struct {
+	mu    sync.Mutex
+	trips map[string]*coalescedTrip
+	flush func(fix driverFix) error
+}
+
+type driverFix struct {
+	tripID     string
+	driverID   string
+	payload    LocationUpdatePayload
+	receivedAt time.Time
+}
+
+type coalescedTrip struct {
+	pending   *driverFix
+	last      *driverFix
+	lastFlush time.Time
+	timer     *time.Timer
+}
+
+func newLocationCoalescer(flush func(fix driverFix) error) *locationCoalescer {
+	return &locationCoalescer{
+		trips: make(map[string]*coalescedTrip),
+		flush: flush,
+	}
+}
+
+// Submit records fix as the trip's latest position. It flushes on the
+// caller's goroutine when the trip is due, returning the flush error, and
+// otherwise schedules a deferred flush.
+func (lc *locationCoalescer) Submit(fix driverFix) error {
+	lc.mu.Lock()
+	ct, ok := lc.trips[fix.tripID]
+	if !ok {
+		ct = &coalescedTrip{}
+		lc.trips[fix.tripID] = ct
+	}
+	ct.pending = &fix
+
+	if ct.timer != nil {
+		lc.mu.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	if wait := ct.dueIn(now); wait > 0 {
+		ct.timer = time.AfterFunc(wait, func() { lc.fire(fix.tripID, ct) })
+		lc.mu.Unlock()
+		return nil
+	}
+
+	next := ct.take(now)
+	lc.mu.Unlock()
+	return lc.flush(next)
+}
+
+// fire runs a deferred flush for ct. A timer that went off just as its trip
+// was forgotten (and maybe started again) finds ct gone and does nothing.
+func (lc *locationCoalescer) fire(tripID string, ct *coalescedTrip) {
+	lc.mu.Lock()
+	if lc.trips[tripID] != ct {
+		lc.mu.Unlock()
+		return
+	}
+	ct.timer = nil
+	if ct.pending == nil {
+		lc.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	if wait := ct.dueIn(now); wait > 0 {
+		ct.timer = time.AfterFunc(wait, func() { lc.fire(tripID, ct) })
+		lc.mu.Unlock()
+		return
+	}
+
+	next := ct.take(now)
+	lc.mu.Unlock()
+	if err := lc.flush(next); err != nil {
+		log.Printf("deferred location flush failed for trip %s: %v", tripID, err)
+	}
+}
+
+// Forget drops any pending fix for a trip that has ended.
+func (lc *locationCoalescer) Forget(tripID string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if ct, ok := lc.trips[tripID]; ok {
+		if ct.timer != nil {
+			ct.timer.Stop()
+		}
+		delete(lc.trips, tripID)
+	}
+}
+
+// FlushAll writes out every pending driver fix immediately.
+func (lc *locationCoalescer) FlushAll() {
+	lc.mu.Lock()
+	now := time.Now()
+	pending := make([]driverFix, 0, len(lc.trips))
+	for _, ct := range lc.trips {
+		if ct.timer != nil {
+			ct.timer.Stop()
+			ct.timer = nil
+		}
+		if ct.pending != nil {
+			pending = append(pending, ct.take(now))
+		}
+	}
+	lc.mu.Unlock()
+
+	for _, fix := range pending {
+		_ = lc.flush(fix)
+	}
+}
+
+func (ct *coalescedTrip) dueIn(now time.Time) time.Duration {
+	if ct.last == nil {
+		return 0
+	}
+
+	elapsed := now.Sub(ct.lastFlush)
+	if elapsed < cfg.LocationFlushInterval {
+		return cfg.LocationFlushInterval - elapsed
+	}
+
+	moved := haversineMeters(ct.last.payload.Lat, ct.last.payload.Lng, ct.pending.payload.Lat, ct.pending.payload.Lng)
+	if moved < cfg.LocationMinDisplacementM && elapsed < cfg.LocationMaxSilence {
+		return cfg.LocationMaxSilence - elapsed
+	}
+	return 0
+}
+
+func (ct *coalescedTrip) take(now time.Time) driverFix {
+	next := *ct.pending
+	ct.pending = nil
+	ct.last = &next
+	ct.lastFlush = now
+	return next
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// useDefaultConfig runs a test against the default configuration, which it
+// may then adjust, and puts the previous one back afterwards.
+func useDefaultConfig(t *testing.T) {
+	t.Helper()
+	saved := cfg
+	cfg = defaultLiveConfig()
+	t.Cleanup(func() { cfg = saved })
+}
+
+func TestCoalescedTripDueIn(t *testing.T) {
+	useDefaultConfig(t)
+	base := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	ct := &coalescedTrip{pending: &driverFix{payload: LocationUpdatePayload{Lat: 12.97, Lng: 77.59}}}
+	if wait := ct.dueIn(base); wait != 0 {
+		t.Fatalf("first fix waits %v, want it flushed at once", wait)
+	}
+	ct.take(base)
+
+	// The next fix moved about a kilometre.
+	ct.pending = &driverFix{payload: LocationUpdatePayload{Lat: 12.98, Lng: 77.59}}
+	if wait := ct.dueIn(base.Add(300 * time.Millisecond)); wait != cfg.LocationFlushInterval-300*time.Millisecond {
+		t.Errorf("inside the flush interval: waits %v, want the rest of the interval", wait)
+	}
+	if wait := ct.dueIn(base.Add(cfg.LocationFlushInterval)); wait != 0 {
+		t.Errorf("after the flush interval: waits %v, want 0", wait)
+	}
+
+	// One that barely moved is held until the max silence runs out.
+	ct.pending = &driverFix{payload: LocationUpdatePayload{Lat: 12.97001, Lng: 77.59}}
+	if wait := ct.dueIn(base.Add(2 * time.Second)); wait != cfg.LocationMaxSilence-2*time.Second {
+		t.Errorf("barely moved: waits %v, want the rest of the max silence", wait)
+	}
+	if wait := ct.dueIn(base.Add(cfg.LocationMaxSilence)); wait != 0 {
+		t.Errorf("barely moved after the max silence: waits %v, want 0", wait)
+	}
+}
+
+func TestLocationCoalescerDefersToNewestFix(t *testing.T) {
+	useDefaultConfig(t)
+	cfg.LocationFlushInterval = 50 * time.Millisecond
+
+	flushed := make(chan float64, 4)
+	lc := newLocationCoalescer(func(fix driverFix) error {
+		flushed <- fix.payload.Lat
+		return nil
+	})
+	submit := func(lat float64) {
+		t.Helper()
+		if err := lc.Submit(driverFix{tripID: "t1", payload: LocationUpdatePayload{TripID: "t1", Lat: lat, Lng: 77.59}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	submit(12.97)
+	if lat := <-flushed; lat != 12.97 {
+		t.Fatalf("first flush was %v, want 12.97 straight away", lat)
+	}
+	// Both arrive inside the interval; only the newer one is flushed, once.
+	submit(12.98)
+	submit(12.99)
+	select {
+	case lat := <-flushed:
+		if lat != 12.99 {
+			t.Errorf("deferred flush was %v, want 12.99", lat)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("deferred flush never happened")
+	}
+	select {
+	case lat := <-flushed:
+		t.Errorf("unexpected extra flush of %v", lat)
+	case <-time.After(3 * cfg.LocationFlushInterval):
+	}
+}
+
+func TestLocationCoalescerForgetCancelsDeferredFlush(t *testing.T) {
+	useDefaultConfig(t)
+	cfg.LocationFlushInterval = 50 * time.Millisecond
+
+	flushed := make(chan driverFix, 4)
+	lc := newLocationCoalescer(func(fix driverFix) error {
+		flushed <- fix
+		return nil
+	})
+	_ = lc.Submit(driverFix{tripID: "t1", payload: LocationUpdatePayload{Lat: 12.97, Lng: 77.59}})
+	<-flushed
+	_ = lc.Submit(driverFix{tripID: "t1", payload: LocationUpdatePayload{Lat: 12.98, Lng: 77.59}})
+
+	// A timer that already went off must not flush for the forgotten trip
+	// either, even after the trip ID is reused.
+	lc.mu.Lock()
+	stale := lc.trips["t1"]
+	lc.mu.Unlock()
+	lc.Forget("t1")
+	lc.fire("t1", stale)
+	_ = lc.Submit(driverFix{tripID: "t1", payload: LocationUpdatePayload{Lat: 13.5, Lng: 77.59}})
+	if fix := <-flushed; fix.payload.Lat != 13.5 {
+		t.Fatalf("flushed %v, want only the fix submitted after Forget", fix.payload.Lat)
+	}
+	lc.fire("t1", stale)
+
+	select {
+	case fix := <-flushed:
+		t.Errorf("forgotten fix %v was flushed", fix.payload.Lat)
+	case <-time.After(3 * cfg.LocationFlushInterval):
+	}
+}
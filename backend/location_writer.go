@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// locationWriter buffers the latest position per driver trip and per rider
+// and writes them to Postgres in periodic batches, so the socket path never
+// waits on the database. Anything that reads live_trips or live_users for a
+// decision flushes the rows it needs first. Every accepted driver fix is
+// also kept, in order, for the trip_trace breadcrumb trail.
+//
+// Flushes of the same trip or rider never overlap: a flush waits for any
+// write already carrying one of its keys, so a FlushTrip that finds the
+// buffer empty still returns only once the periodic Flush that took the
+// trip's rows has landed them.
+type locationWriter struct {
+	mu      sync.Mutex
+	drivers map[string]driverFix
+	riders  map[string]riderFix
+	trace   []driverFix
+
+	writingTrips  map[string]bool
+	writingRiders map[string]bool
+	written       *sync.Cond
+}
+
+// maxBufferedTrace bounds the breadcrumbs held while the database is
+// unreachable; the oldest are dropped first.
+const maxBufferedTrace = 50000
+
+type riderFix struct {
+	tripID     string
+	userID     string
+	payload    LocationUpdatePayload
+	receivedAt time.Time
+}
+
+func newLocationWriter() *locationWriter {
+	w := &locationWriter{
+		drivers:       make(map[string]driverFix),
+		riders:        make(map[string]riderFix),
+		writingTrips:  make(map[string]bool),
+		writingRiders: make(map[string]bool),
+	}
+	w.written = sync.NewCond(&w.mu)
+	return w
+}
+
+func (w *locationWriter) PutDriver(fix driverFix) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.drivers[fix.tripID] = fix
+}
+
+// PutTrace appends a breadcrumb. It takes every driver fix the filter
+// accepts, ahead of the coalescer, so the trail is not thinned to the
+// broadcast rate.
+func (w *locationWriter) PutTrace(fix driverFix) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.trace = append(w.trace, fix)
+	w.trimTraceLocked()
+}
+
+func (w *locationWriter) trimTraceLocked() {
+	if len(w.trace) > maxBufferedTrace {
+		log.Printf("trace buffer full, dropping %d breadcrumbs", len(w.trace)-maxBufferedTrace)
+		w.trace = w.trace[len(w.trace)-maxBufferedTrace:]
+	}
+}
+
+func (w *locationWriter) PutRider(fix riderFix) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.riders[fix.userID] = fix
+}
+
+func (w *locationWriter) Run(ctx context.Context) {
+	ticker := time.NewTicker(cfg.LocationWriteInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			flushCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			if err := w.Flush(flushCtx); err != nil {
+				log.Printf("live location flush failed: %v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// Flush writes everything buffered.
+func (w *locationWriter) Flush(ctx context.Context) error {
+	return w.flushMatching(ctx, func(string) bool { return true }, func(string) bool { return true })
+}
+
+// FlushTrip writes the buffered driver position and breadcrumbs of a trip.
+func (w *locationWriter) FlushTrip(ctx context.Context, tripID string) error {
+	return w.flushMatching(ctx, func(id string) bool { return id == tripID }, func(string) bool { return false })
+}
+
+// FlushRider writes the buffered position of one rider.
+func (w *locationWriter) FlushRider(ctx context.Context, userID string) error {
+	return w.flushMatching(ctx, func(string) bool { return false }, func(id string) bool { return id == userID })
+}
+
+// ForgetTrip drops buffered positions for a trip whose live rows have just
+// been cleared, along with those of its riders.
+func (w *locationWriter) ForgetTrip(tripID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.drivers, tripID)
+	w.trace = slices.DeleteFunc(w.trace, func(fix driverFix) bool { return fix.tripID == tripID })
+	for userID, fix := range w.riders {
+		if fix.tripID == tripID {
+			delete(w.riders, userID)
+		}
+	}
+}
+
+func (w *locationWriter) ForgetRider(userID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.riders, userID)
+}
+
+func (w *locationWriter) flushMatching(ctx context.Context, tripMatch, riderMatch func(string) bool) error {
+	w.mu.Lock()
+	for w.writingLocked(tripMatch, riderMatch) {
+		w.written.Wait()
+	}
+	var drivers []driverFix
+	for tripID, fix := range w.drivers {
+		if tripMatch(tripID) {
+			drivers = append(drivers, fix)
+			delete(w.drivers, tripID)
+		}
+	}
+	var riders []riderFix
+	for userID, fix := range w.riders {
+		if riderMatch(userID) {
+			riders = append(riders, fix)
+			delete(w.riders, userID)
+		}
+	}
+	var trace, kept []driverFix
+	for _, fix := range w.trace {
+		if tripMatch(fix.tripID) {
+			trace = append(trace, fix)
+		} else {
+			kept = append(kept, fix)
+		}
+	}
+	w.trace = kept
+	w.markLocked(drivers, riders, trace, true)
+	w.mu.Unlock()
+
+	err := writeLiveLocations(ctx, drivers, riders, trace)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.markLocked(drivers, riders, trace, false)
+	if err != nil {
+		w.requeueLocked(drivers, riders, trace)
+	}
+	w.written.Broadcast()
+	return err
+}
+
+// writingLocked reports whether a write in progress carries a trip or rider
+// the matchers select.
+func (w *locationWriter) writingLocked(tripMatch, riderMatch func(string) bool) bool {
+	for tripID := range w.writingTrips {
+		if tripMatch(tripID) {
+			return true
+		}
+	}
+	for userID := range w.writingRiders {
+		if riderMatch(userID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *locationWriter) markLocked(drivers []driverFix, riders []riderFix, trace []driverFix, writing bool) {
+	mark := func(m map[string]bool, key string) {
+		if writing {
+			m[key] = true
+		} else {
+			delete(m, key)
+		}
+	}
+	for _, fix := range drivers {
+		mark(w.writingTrips, fix.tripID)
+	}
+	for _, fix := range trace {
+		mark(w.writingTrips, fix.tripID)
+	}
+	for _, fix := range riders {
+		mark(w.writingRiders, fix.userID)
+	}
+}
+
+// requeueLocked puts back fixes from a failed flush unless a newer one
+// arrived in the meantime.
+func (w *locationWriter) requeueLocked(drivers []driverFix, riders []riderFix, trace []driverFix) {
+	w.trace = append(trace, w.trace...)
+	w.trimTraceLocked()
+	for _, fix := range drivers {
+		if _, newer := w.drivers[fix.tripID]; !newer {
+			w.drivers[fix.tripID] = fix
+		}
+	}
+	for _, fix := range riders {
+		if _, newer := w.riders[fix.userID]; !newer {
+			w.riders[fix.userID] = fix
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLocationWriterRequeueKeepsNewerFixes(t *testing.T) {
+	w := newLocationWriter()
+	w.PutDriver(driverFix{tripID: "t1", payload: LocationUpdatePayload{Lat: 2}})
+	w.PutRider(riderFix{userID: "u1", payload: LocationUpdatePayload{Lat: 2}})
+
+	// A flush carrying older positions for t1 and u1, and the only one for
+	// t2, failed while the newer ones were buffered.
+	w.mu.Lock()
+	w.requeueLocked(
+		[]driverFix{{tripID: "t1", payload: LocationUpdatePayload{Lat: 1}}, {tripID: "t2", payload: LocationUpdatePayload{Lat: 1}}},
+		[]riderFix{{userID: "u1", payload: LocationUpdatePayload{Lat: 1}}},
+		nil,
+	)
+	w.mu.Unlock()
+
+	if got := w.drivers["t1"].payload.Lat; got != 2 {
+		t.Errorf("t1 lat = %v, want the newer 2", got)
+	}
+	if _, ok := w.drivers["t2"]; !ok {
+		t.Error("t2 was not put back")
+	}
+	if got := w.riders["u1"].payload.Lat; got != 2 {
+		t.Errorf("u1 lat = %v, want the newer 2", got)
+	}
+}
+
+func TestLocationWriterRequeueTrace(t *testing.T) {
+	w := newLocationWriter()
+	crumb := driverFix{tripID: "t1"}
+	var failed []driverFix
+	for i := 0; i < maxBufferedTrace; i++ {
+		crumb.payload.Lat = float64(i)
+		failed = append(failed, crumb)
+	}
+	for i := maxBufferedTrace; i < maxBufferedTrace+10; i++ {
+		crumb.payload.Lat = float64(i)
+		w.PutTrace(crumb)
+	}
+
+	// The failed breadcrumbs go back ahead of the newer ones, and the
+	// oldest are dropped to stay within the bound.
+	w.mu.Lock()
+	w.requeueLocked(nil, nil, failed)
+	w.mu.Unlock()
+
+	if len(w.trace) != maxBufferedTrace {
+		t.Fatalf("trace holds %d breadcrumbs, want %d", len(w.trace), maxBufferedTrace)
+	}
+	for i, fix := range w.trace {
+		if want := float64(i + 10); fix.payload.Lat != want {
+			t.Fatalf("breadcrumb %d is %v, want %v", i, fix.payload.Lat, want)
+		}
+	}
+}
+
+func TestLocationWriterForgetTrip(t *testing.T) {
+	w := newLocationWriter()
+	w.PutDriver(driverFix{tripID: "t1"})
+	w.PutDriver(driverFix{tripID: "t2"})
+	w.PutTrace(driverFix{tripID: "t1"})
+	w.PutTrace(driverFix{tripID: "t2"})
+	w.PutRider(riderFix{tripID: "t1", userID: "u1"})
+	w.PutRider(riderFix{tripID: "t2", userID: "u2"})
+
+	w.ForgetTrip("t1")
+
+	if _, ok := w.drivers["t1"]; ok || len(w.drivers) != 1 {
+		t.Errorf("drivers = %v, want only t2", w.drivers)
+	}
+	if len(w.trace) != 1 || w.trace[0].tripID != "t2" {
+		t.Errorf("trace = %v, want only t2", w.trace)
+	}
+	if _, ok := w.riders["u1"]; ok || len(w.riders) != 1 {
+		t.Errorf("riders = %v, want only u2", w.riders)
+	}
+}
+
+func TestLocationWriterFlushWaitsForWriteOfSameTrip(t *testing.T) {
+	w := newLocationWriter()
+	// A periodic flush has taken t1's rows and is still writing them.
+	w.mu.Lock()
+	w.writingTrips["t1"] = true
+	w.mu.Unlock()
+
+	if err := w.FlushTrip(context.Background(), "t2"); err != nil {
+		t.Fatalf("FlushTrip(t2): %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- w.FlushTrip(context.Background(), "t1") }()
+	select {
+	case <-done:
+		t.Fatal("FlushTrip(t1) returned while t1 was still being written")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	w.mu.Lock()
+	delete(w.writingTrips, "t1")
+	w.written.Broadcast()
+	w.mu.Unlock()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("FlushTrip(t1): %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("FlushTrip(t1) still waiting after the write finished")
+	}
+}
+
+func TestEnvInterval(t *testing.T) {
+	for _, raw := range []string{"0", "0s", "-1s", "soon"} {
+		t.Setenv("LOCATION_WRITE_INTERVAL", raw)
+		if got := envInterval("LOCATION_WRITE_INTERVAL", 2*time.Second); got != 2*time.Second {
+			t.Errorf("envInterval(%q) = %v, want the 2s fallback", raw, got)
+		}
+	}
+	t.Setenv("LOCATION_WRITE_INTERVAL", "500ms")
+	if got := envInterval("LOCATION_WRITE_INTERVAL", 2*time.Second); got != 500*time.Millisecond {
+		t.Errorf("envInterval(\"500ms\") = %v, want 500ms", got)
+	}
+}
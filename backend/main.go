@@ -2,16 +2,31 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
 )
 
 func main() {
+	// `yatra-backend ws-catalog` prints the socket protocol catalogue for
+	// client code generation without needing a database.
+	if len(os.Args) > 1 && os.Args[1] == "ws-catalog" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(wsCatalog()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	_ = godotenv.Load("../.env.production")
 
 	// Validate required environment variables
@@ -29,6 +44,10 @@ func main() {
 		log.Fatal("FRONTEND_ORIGIN is required")
 	}
 
+	cfg = loadLiveConfig()
+	sosNotifiers = loadSOSNotifiers()
+	opsWebhook = loadOpsHook()
+
 	var err error
 	dbPool, err = pgxpool.New(context.Background(), databaseURL)
 	if err != nil {
@@ -42,8 +61,66 @@ func main() {
 	}
 	log.Println("Database connection verified")
 
+	partCtx, cancelPart := context.WithTimeout(context.Background(), 5*time.Minute)
+	if err := ensureTracePartitions(partCtx, time.Now().UTC()); err != nil {
+		log.Fatalf("failed to prepare trip_trace partitions: %v", err)
+	}
+	cancelPart()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	pubSubCtx, stopPubSub := context.WithCancel(context.Background())
+	defer stopPubSub()
+	hub.StartPubSub(pubSubCtx)
+
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	go liveLocations.Run(jobsCtx)
+	go runChatRetention(jobsCtx)
+	go runSOSEscalation(jobsCtx)
+	go runSignalWatchdog(jobsCtx)
+	go runTracePartitions(jobsCtx)
+
 	setupRoutes()
 
-	log.Println("Starting Yatra Backend on :8080...")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	srv := &http.Server{Addr: ":8080"}
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Println("Starting Yatra Backend on :8080...")
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	// A server that fails still goes through the shutdown below, so buffered
+	// positions are written and sockets told, and exits non-zero after.
+	serveFailed := false
+	select {
+	case err := <-serveErr:
+		log.Printf("server error: %v", err)
+		serveFailed = true
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down, draining connections...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGrace)
+	defer cancel()
+
+	// Warn clients before anything closes, then let in-flight API requests
+	// (trip start/complete transactions included) finish. Sockets are closed
+	// last so their cleanup still has the pool.
+	hub.Drain()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("http shutdown: %v", err)
+	}
+	driverLocations.FlushAll()
+	hub.CloseAll(shutdownCtx)
+	stopJobs()
+	if err := liveLocations.Flush(shutdownCtx); err != nil {
+		log.Printf("final live location flush: %v", err)
+	}
+	stopPubSub()
+	log.Println("Shutdown complete")
+	if serveFailed {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The ops hook carries operational signals that are not emergencies, such
+// as route deviations, to OPS_WEBHOOK_URL (signed with OPS_WEBHOOK_SECRET
+// like the SOS webhook). Without a URL the signal is only logged.
+
+var opsWebhook *webhookNotifier
+
+func loadOpsHook() *webhookNotifier {
+	url := strings.TrimSpace(os.Getenv("OPS_WEBHOOK_URL"))
+	if url == "" {
+		return nil
+	}
+	return &webhookNotifier{
+		url:    url,
+		secret: os.Getenv("OPS_WEBHOOK_SECRET"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// notifyOps posts {"event": event, "data": data} in the background.
+func notifyOps(event string, data interface{}) {
+	if opsWebhook == nil {
+		log.Printf("ops event %s: %+v", event, data)
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		if err := opsWebhook.post(ctx, map[string]interface{}{"event": event, "data": data}); err != nil {
+			log.Printf("ops hook %s failed: %v", event, err)
+		}
+	}()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Inbound frames are metered by token buckets at two levels: per event type
+// on each connection, and per user across all of that user's connections.
+// A dropped frame counts as a violation; too many violations inside the
+// window closes the socket with a policy-violation frame.
+
+// rateKeyOther meters malformed frames and unknown events together so junk
+// cannot mint a bucket per distinct event name.
+const rateKeyOther = "_other"
+
+type rateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+type tokenBucket struct {
+	limit  rateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(l rateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{limit: l, tokens: l.Burst, last: now}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	if !b.ready(now) {
+		return false
+	}
+	b.take()
+	return true
+}
+
+// ready refills the bucket up to now and reports whether it holds a token,
+// without spending it.
+func (b *tokenBucket) ready(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if b.tokens > b.limit.Burst {
+		b.tokens = b.limit.Burst
+	}
+	b.last = now
+	return b.tokens >= 1
+}
+
+func (b *tokenBucket) take() {
+	b.tokens--
+}
+
+// connLimiter is only touched by the connection's reader goroutine.
+type connLimiter struct {
+	buckets     map[string]*tokenBucket
+	violations  int
+	windowStart time.Time
+	lastNotice  time.Time
+	closing     bool
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+type userRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+var userLimiter = &userRateLimiter{buckets: make(map[string]*tokenBucket)}
+
+func (u *userRateLimiter) allow(key string, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if now.Sub(u.lastPrune) > time.Minute {
+		for k, b := range u.buckets {
+			if now.Sub(b.last) > time.Minute {
+				delete(u.buckets, k)
+			}
+		}
+		u.lastPrune = now
+	}
+
+	b, ok := u.buckets[key]
+	if !ok {
+		b = newTokenBucket(cfg.WSUserLimit, now)
+		u.buckets[key] = b
+	}
+	return b.allow(now)
+}
+
+// allowFrame reports whether the reader should process a frame for event.
+// It replies with a rate_limited error at most once a second and closes the
+// connection once the violation budget is spent.
+func (c *Client) allowFrame(req Message, event string) bool {
+	now := time.Now()
+	key := event
+	if _, known := cfg.WSEventLimits[key]; !known {
+		key = rateKeyOther
+	}
+
+	b, ok := c.limiter.buckets[key]
+	if !ok {
+		b = newTokenBucket(cfg.WSEventLimits[key], now)
+		c.limiter.buckets[key] = b
+	}
+	// The event bucket is only charged once the user bucket has let the
+	// frame through, so frames the user limit drops do not use it up.
+	if b.ready(now) && userLimiter.allow(c.rateKey(), now) {
+		b.take()
+		return true
+	}
+
+	l := c.limiter
+	if now.Sub(l.windowStart) > cfg.WSViolationWindow {
+		l.windowStart = now
+		l.violations = 0
+	}
+	l.violations++
+
+	if l.closing {
+		return false
+	}
+	if l.violations >= cfg.WSMaxViolations {
+		l.closing = true
+		log.Printf("rate limit: closing %s after %d violations (last event %q)", c.logID(), l.violations, event)
+		c.close(websocket.ClosePolicyViolation, "rate limit exceeded")
+		return false
+	}
+	if now.Sub(l.lastNotice) >= time.Second {
+		log.Printf("rate limit: throttling %s on %q", c.logID(), event)
+		c.replyError(req, errCodeRateLimited, "rate limit exceeded")
+		l.lastNotice = now
+	}
+	return false
+}
+
+func (c *Client) rateKey() string {
+	if c.shareID != "" {
+		return "share:" + c.shareID
+	}
+	return "user:" + c.userID
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	base := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	b := newTokenBucket(rateLimit{Rate: 2, Burst: 2}, base)
+
+	if !b.allow(base) || !b.allow(base) {
+		t.Fatal("burst not available on a fresh bucket")
+	}
+	if b.allow(base) {
+		t.Fatal("allowed a frame past the burst")
+	}
+	if b.allow(base.Add(250 * time.Millisecond)) {
+		t.Error("allowed a frame on half a token")
+	}
+	if !b.allow(base.Add(500 * time.Millisecond)) {
+		t.Error("no token after refilling for one")
+	}
+
+	later := base.Add(time.Hour)
+	if !b.allow(later) || !b.allow(later) || b.allow(later) {
+		t.Error("refill went past the burst")
+	}
+}
+
+func TestTokenBucketReadyDoesNotSpend(t *testing.T) {
+	base := time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC)
+	b := newTokenBucket(rateLimit{Rate: 0, Burst: 1}, base)
+
+	if !b.ready(base) || !b.ready(base) {
+		t.Fatal("ready spent the token")
+	}
+	b.take()
+	if b.ready(base.Add(time.Hour)) {
+		t.Error("zero-rate bucket refilled")
+	}
+}
+
+func TestAllowFrameKeepsEventTokenWhenUserLimited(t *testing.T) {
+	useDefaultConfig(t)
+	cfg.WSEventLimits = map[string]rateLimit{"chat_send": {Rate: 0, Burst: 1}, rateKeyOther: {Rate: 0, Burst: 1}}
+	cfg.WSUserLimit = rateLimit{Rate: 0, Burst: 1}
+	cfg.WSMaxViolations = 100
+	saved := userLimiter
+	userLimiter = &userRateLimiter{buckets: make(map[string]*tokenBucket)}
+	t.Cleanup(func() { userLimiter = saved })
+
+	msg := Message{Event: "chat_send"}
+	first, second := newClient(nil, "u1"), newClient(nil, "u1")
+	if !first.allowFrame(msg, "chat_send") {
+		t.Fatal("first frame dropped")
+	}
+	// The user's only token is gone, so the second connection's frame is
+	// dropped without touching its own chat_send bucket.
+	if second.allowFrame(msg, "chat_send") {
+		t.Fatal("user limit not shared across connections")
+	}
+
+	userLimiter.mu.Lock()
+	userLimiter.buckets["user:u1"].tokens = 1
+	userLimiter.mu.Unlock()
+	if !second.allowFrame(msg, "chat_send") {
+		t.Error("event token was spent by the frame the user limit dropped")
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Replay streams a finished trip back to one connection: the recorded
+// breadcrumbs as driver_location_updated and the lifecycle events from
+// trip_events, with the payloads the live room uses, spaced by their
+// original timing divided by the playback speed. Replayed frames carry
+// "replay": true in the envelope and no seq, and never touch the room.
+
+const (
+	replayMinSpeed       = 0.1
+	replayMaxSpeed       = 100
+	maxReplaysPerConn    = 3
+	replayStatePlaying   = "playing"
+	replayStatePaused    = "paused"
+	replayStateEnded     = "ended"
+	replayStateStopped   = "stopped"
+	replayLoadTimeout    = 15 * time.Second
+	replayLocationEvent  = "driver_location_updated"
+	replayDefaultSpeed   = 1.0
+	replayMaxTimelineLen = 200000
+)
+
+type replayFrame struct {
+	offset  time.Duration
+	event   string
+	payload interface{}
+}
+
+type replaySession struct {
+	c       *Client
+	tripID  string
+	frames  []replayFrame
+	startAt time.Time
+
+	mu     sync.Mutex
+	next   int
+	offset time.Duration // playback position when anchor was taken
+	anchor time.Time
+	speed  float64
+	paused bool
+	ended  bool
+	// removed is set once the session has left c.replays; a control
+	// message can no longer bring it back.
+	removed bool
+	wake    chan struct{}
+}
+
+// loadReplay builds the timeline of a completed trip.
+func loadReplay(ctx context.Context, c *Client, tripID string) (*replaySession, error) {
+	points, err := getTripTrace(ctx, tripID)
+	if err != nil {
+		return nil, err
+	}
+	events, err := getTripEvents(ctx, tripID)
+	if err != nil {
+		return nil, err
+	}
+
+	type timed struct {
+		at    time.Time
+		frame replayFrame
+	}
+	var all []timed
+	for _, e := range events {
+		var payload interface{}
+		switch e.Event {
+		case "trip_started":
+			payload = TripStatusPayload{TripID: tripID, Status: "ongoing"}
+		case "trip_completed":
+			payload = TripStatusPayload{TripID: tripID, Status: "completed"}
+		case "rider_onboard":
+			payload = RiderStatusPayload{TripID: tripID, RequestID: e.RequestID, Status: "onboard"}
+		case "rider_dropped_off":
+			payload = RiderStatusPayload{TripID: tripID, RequestID: e.RequestID, Status: "dropedoff"}
+		default:
+			continue
+		}
+		all = append(all, timed{e.OccurredAt, replayFrame{event: e.Event, payload: payload}})
+	}
+	// A timeline longer than replayMaxTimelineLen keeps every lifecycle
+	// event and thins the breadcrumbs evenly instead.
+	if budget := replayMaxTimelineLen - len(all); len(points) > budget {
+		points = thinTrace(points, max(budget, 2))
+	}
+	for _, p := range points {
+		all = append(all, timed{p.RecordedAt, replayFrame{
+			event: replayLocationEvent,
+			payload: DriverLocationPayload{
+				TripID:     tripID,
+				Lat:        p.Lat,
+				Lng:        p.Lng,
+				Heading:    p.Heading,
+				SpeedKmph:  p.SpeedKmph,
+				UpdatedAt:  p.RecordedAt.UTC().Format(time.RFC3339),
+				SourceRole: "driver",
+			},
+		}})
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].at.Before(all[j].at) })
+
+	s := &replaySession{c: c, tripID: tripID, speed: replayDefaultSpeed, wake: make(chan struct{}, 1)}
+	if len(all) > 0 {
+		s.startAt = all[0].at
+	}
+	s.frames = make([]replayFrame, len(all))
+	for i, t := range all {
+		t.frame.offset = t.at.Sub(s.startAt)
+		s.frames[i] = t.frame
+	}
+	return s, nil
+}
+
+// thinTrace picks n points spread evenly over the trace, keeping the first
+// and the last.
+func thinTrace(points []tracePoint, n int) []tracePoint {
+	if len(points) <= n {
+		return points
+	}
+	out := make([]tracePoint, n)
+	for i := range out {
+		out[i] = points[i*(len(points)-1)/(n-1)]
+	}
+	return out
+}
+
+func (s *replaySession) duration() time.Duration {
+	if len(s.frames) == 0 {
+		return 0
+	}
+	return s.frames[len(s.frames)-1].offset
+}
+
+func (s *replaySession) positionLocked(now time.Time) time.Duration {
+	if s.paused || s.ended {
+		return s.offset
+	}
+	return s.offset + time.Duration(float64(now.Sub(s.anchor))*s.speed)
+}
+
+func (s *replaySession) stateLocked(now time.Time) ReplayStatePayload {
+	state := replayStatePlaying
+	switch {
+	case s.ended:
+		state = replayStateEnded
+	case s.paused:
+		state = replayStatePaused
+	}
+	return ReplayStatePayload{
+		TripID:     s.tripID,
+		State:      state,
+		PositionMs: s.positionLocked(now).Milliseconds(),
+		DurationMs: s.duration().Milliseconds(),
+		Speed:      s.speed,
+		StartedAt:  s.startAt.UTC().Format(time.RFC3339),
+	}
+}
+
+func (s *replaySession) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// seekLocked moves playback to pos. Everything the viewer would have seen
+// by then is summarised: every lifecycle event before pos, then the last
+// driver position before it.
+func (s *replaySession) seekLocked(pos time.Duration, now time.Time) []replayFrame {
+	pos = max(0, min(pos, s.duration()))
+	s.offset = pos
+	s.anchor = now
+	s.ended = false
+
+	var catchUp []replayFrame
+	var lastLocation *replayFrame
+	i := 0
+	for ; i < len(s.frames) && s.frames[i].offset < pos; i++ {
+		f := s.frames[i]
+		if f.event == replayLocationEvent {
+			lastLocation = &s.frames[i]
+		} else {
+			catchUp = append(catchUp, f)
+		}
+	}
+	s.next = i
+	if lastLocation != nil {
+		catchUp = append(catchUp, *lastLocation)
+	}
+	return catchUp
+}
+
+func (s *replaySession) send(f replayFrame) {
+	s.c.writeJSON(SocketResponse{Event: f.event, Payload: f.payload, TripID: s.tripID, Replay: true})
+}
+
+func (s *replaySession) sendState() {
+	s.mu.Lock()
+	state := s.stateLocked(time.Now())
+	s.mu.Unlock()
+	s.c.writeJSON(SocketResponse{Event: "replay_state", Payload: state, TripID: s.tripID, Replay: true})
+}
+
+// run plays frames until the timeline ends, the session is stopped or the
+// connection closes.
+func (s *replaySession) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		if s.ended {
+			s.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		wait := time.Duration(-1)
+		var due *replayFrame
+		switch {
+		case s.paused:
+		case s.next >= len(s.frames):
+			s.offset = s.duration()
+			s.ended = true
+		default:
+			f := s.frames[s.next]
+			if ahead := f.offset - s.positionLocked(now); ahead > 0 {
+				wait = time.Duration(float64(ahead) / s.speed)
+			} else {
+				due = &f
+				s.next++
+			}
+		}
+		ended := s.ended
+		s.mu.Unlock()
+
+		if due != nil {
+			// At high speeds frames fall due faster than the socket drains;
+			// hold back rather than trip the slow-consumer cutoff.
+			for len(s.c.send) > sendQueueSize/2 {
+				select {
+				case <-s.c.done:
+					return
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+			s.send(*due)
+			continue
+		}
+		if ended {
+			s.sendState()
+			// A seek in the meantime restarts playback; otherwise the
+			// session is done and must not be revived by a late control.
+			s.mu.Lock()
+			if !s.ended {
+				s.mu.Unlock()
+				continue
+			}
+			s.removed = true
+			s.mu.Unlock()
+			s.c.removeReplay(s.tripID, s)
+			return
+		}
+
+		if wait >= 0 {
+			timer.Reset(wait)
+		}
+		select {
+		case <-s.c.done:
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
+
+func (c *Client) replay(tripID string) (*replaySession, bool) {
+	c.replayMu.Lock()
+	defer c.replayMu.Unlock()
+	s, ok := c.replays[tripID]
+	return s, ok
+}
+
+func (c *Client) removeReplay(tripID string, s *replaySession) {
+	c.replayMu.Lock()
+	defer c.replayMu.Unlock()
+	if c.replays[tripID] == s {
+		delete(c.replays, tripID)
+	}
+}
+
+// validReplayStaffToken checks a staff token against REPLAY_STAFF_TOKEN.
+func validReplayStaffToken(given string) bool {
+	return cfg.ReplayStaffToken != "" && subtle.ConstantTimeCompare([]byte(given), []byte(cfg.ReplayStaffToken)) == 1
+}
+
+func handleReplayTrip(c *Client, msg Message, payload *ReplayTripPayload) {
+	staff := payload.StaffToken != "" && validReplayStaffToken(payload.StaffToken)
+	if payload.StaffToken != "" && !staff {
+		c.replyError(msg, errCodeForbidden, "invalid staff token")
+		return
+	}
+	if !staff && c.userID == "" {
+		c.replyError(msg, errCodeForbidden, "replay requires an account")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), replayLoadTimeout)
+	defer cancel()
+
+	if !staff && !isTripParticipant(ctx, payload.TripID, c.userID) {
+		c.replyError(msg, errCodeForbidden, "not a participant of this trip")
+		return
+	}
+	status, err := getTripStatus(ctx, payload.TripID)
+	if err != nil {
+		c.replyError(msg, errCodeNotFound, "trip not found")
+		return
+	}
+	if status != "completed" {
+		c.replyError(msg, errCodeForbidden, "only completed trips can be replayed")
+		return
+	}
+
+	s, err := loadReplay(ctx, c, payload.TripID)
+	if err != nil {
+		c.replyError(msg, errCodeUpdateFailed, "failed to load trip history")
+		return
+	}
+	if payload.Speed > 0 {
+		s.speed = payload.Speed
+	}
+
+	c.replayMu.Lock()
+	if old, ok := c.replays[payload.TripID]; ok {
+		old.stop()
+	} else if len(c.replays) >= maxReplaysPerConn {
+		c.replayMu.Unlock()
+		c.replyError(msg, errCodeRateLimited, "too many replays on this connection")
+		return
+	}
+	c.replays[payload.TripID] = s
+	c.replayMu.Unlock()
+
+	s.mu.Lock()
+	catchUp := s.seekLocked(time.Duration(payload.PositionMs)*time.Millisecond, time.Now())
+	state := s.stateLocked(time.Now())
+	s.mu.Unlock()
+
+	c.reply(msg, SocketResponse{Event: "replay_state", Payload: state, TripID: payload.TripID, Replay: true})
+	for _, f := range catchUp {
+		s.send(f)
+	}
+	go s.run()
+}
+
+func handleReplayControl(c *Client, msg Message, payload *ReplayControlPayload) {
+	s, ok := c.replay(payload.TripID)
+	if !ok {
+		c.replyError(msg, errCodeNotFound, "no replay running for this trip")
+		return
+	}
+
+	now := time.Now()
+	var catchUp []replayFrame
+	s.mu.Lock()
+	if s.removed {
+		s.mu.Unlock()
+		c.replyError(msg, errCodeNotFound, "no replay running for this trip")
+		return
+	}
+	switch payload.Action {
+	case "pause":
+		if !s.paused {
+			s.offset = s.positionLocked(now)
+			s.paused = true
+		}
+	case "resume":
+		if s.paused {
+			s.anchor = now
+			s.paused = false
+		}
+	case "seek":
+		catchUp = s.seekLocked(time.Duration(*payload.PositionMs)*time.Millisecond, now)
+	case "speed":
+		s.offset = s.positionLocked(now)
+		s.anchor = now
+		s.speed = *payload.Speed
+	case "stop":
+		s.ended = true
+		s.removed = true
+	}
+	state := s.stateLocked(now)
+	if payload.Action == "stop" {
+		state.State = replayStateStopped
+	}
+	s.mu.Unlock()
+
+	if payload.Action == "stop" {
+		c.removeReplay(payload.TripID, s)
+	}
+	c.reply(msg, SocketResponse{Event: "replay_state", Payload: state, TripID: payload.TripID, Replay: true})
+	for _, f := range catchUp {
+		s.send(f)
+	}
+	s.poke()
+}
+
+func (s *replaySession) stop() {
+	s.mu.Lock()
+	s.ended = true
+	s.removed = true
+	s.mu.Unlock()
+	s.poke()
+}
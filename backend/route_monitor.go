@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// routeMonitor compares each driver fix with the trip's planned route. The
+// driver has to stay more than RouteDeviationM off the line for
+// RouteDeviationSustain before riders hear about it, and counts as back on
+// route once within RouteRejoinM, so a single bad fix or a short detour
+// around a blocked lane raises nothing.
+//
+// It also tracks progress along the route for route_progress.
+// Progress only moves forward: a fix that locates further back is put down
+// to GPS error unless it is more than RouteReversalM back, which only a
+// genuine U-turn or a route that doubles back on itself produces. Fixes
+// off the route leave progress where it was.
+type routeMonitor struct {
+	mu    sync.Mutex
+	trips map[string]*routeState
+}
+
+type routeState struct {
+	noRoute     bool
+	offSince    time.Time
+	deviated    bool
+	progress    float64
+	hasProgress bool
+}
+
+func newRouteMonitor() *routeMonitor {
+	return &routeMonitor{trips: make(map[string]*routeState)}
+}
+
+// Evaluate checks fix against the route and returns the driver's progress
+// along it, or nil when the trip has no route or the lookup failed.
+func (m *routeMonitor) Evaluate(ctx context.Context, fix driverFix) *RouteProgressPayload {
+	m.mu.Lock()
+	state, ok := m.trips[fix.tripID]
+	if !ok {
+		state = &routeState{}
+		m.trips[fix.tripID] = state
+	}
+	noRoute := state.noRoute
+	m.mu.Unlock()
+	if noRoute {
+		return nil
+	}
+
+	pos, err := getRoutePosition(ctx, fix.tripID, fix.payload.Lat, fix.payload.Lng)
+	if err == pgx.ErrNoRows {
+		m.mu.Lock()
+		state.noRoute = true
+		m.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		log.Printf("route check failed for trip %s: %v", fix.tripID, err)
+		return nil
+	}
+	distanceM := pos.DistanceM
+
+	m.mu.Lock()
+	onRoute := distanceM <= cfg.RouteDeviationM
+	if onRoute {
+		backM := (state.progress - pos.Progress) * pos.LengthM
+		if !state.hasProgress || backM <= 0 || backM > cfg.RouteReversalM {
+			state.progress, state.hasProgress = pos.Progress, true
+		}
+	}
+	progress := state.progress
+
+	event := ""
+	var since time.Time
+	switch {
+	case state.deviated && distanceM <= cfg.RouteRejoinM:
+		event, since = "route_rejoined", state.offSince
+		state.deviated = false
+		state.offSince = time.Time{}
+	case !state.deviated && distanceM > cfg.RouteDeviationM:
+		if state.offSince.IsZero() {
+			state.offSince = fix.receivedAt
+		}
+		if fix.receivedAt.Sub(state.offSince) >= cfg.RouteDeviationSustain {
+			event, since = "route_deviation", state.offSince
+			state.deviated = true
+		}
+	case !state.deviated:
+		state.offSince = time.Time{}
+	}
+	m.mu.Unlock()
+
+	result := &RouteProgressPayload{
+		SnappedLat:         pos.SnappedLat,
+		SnappedLng:         pos.SnappedLng,
+		OnRoute:            onRoute,
+		Progress:           math.Round(progress*1000) / 1000,
+		DistanceTravelledM: math.Round(progress * pos.LengthM),
+		DistanceRemainingM: math.Round((1 - progress) * pos.LengthM),
+	}
+	if !onRoute {
+		result.SnappedLat, result.SnappedLng = fix.payload.Lat, fix.payload.Lng
+	}
+
+	if event == "" {
+		return result
+	}
+	payload := RouteDeviationPayload{
+		TripID:       fix.tripID,
+		DistanceM:    math.Round(distanceM),
+		Progress:     progress,
+		Lat:          fix.payload.Lat,
+		Lng:          fix.payload.Lng,
+		OffRouteFrom: since.UTC().Format(time.RFC3339),
+		At:           fix.receivedAt.UTC().Format(time.RFC3339),
+	}
+	hub.BroadcastToTripRole(fix.tripID, "rider", SocketResponse{Event: event, Payload: payload})
+	notifyOps(event, struct {
+		RouteDeviationPayload
+		DriverID string `json:"driverId"`
+	}{payload, fix.driverID})
+	return result
+}
+
+// Forget drops the state of a trip that has ended.
+func (m *routeMonitor) Forget(tripID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.trips, tripID)
+}
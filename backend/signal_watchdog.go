@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// The signal watchdog notices drivers whose position stopped arriving, or
+// never arrived after the trip started. It works from live_trips rather
+// than this instance's sockets, since the driver may be connected anywhere.
+// Each transition is claimed with a conditional UPDATE on
+// trips.signal_lost_at, so when every instance runs the watchdog exactly one
+// of them broadcasts it, and the hub relays the event to the rest. Positions
+// are stamped with the application clock, so the watchdog compares them
+// with its own clock rather than the database's.
+
+func runSignalWatchdog(ctx context.Context) {
+	ticker := time.NewTicker(cfg.SignalWatchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		scanCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		now := time.Now()
+		lost, err := claimLostDriverSignals(scanCtx, now, cfg.DriverSignalTimeout)
+		if err != nil {
+			log.Printf("signal watchdog: lost scan failed: %v", err)
+		}
+		for _, p := range lost {
+			log.Printf("driver signal lost on trip %s (last fix %.0fs ago)", p.TripID, p.AgeSeconds)
+			hub.BroadcastToTrip(p.TripID, SocketResponse{Event: "driver_signal_lost", Payload: p})
+		}
+
+		restored, err := claimRestoredDriverSignals(scanCtx, now)
+		if err != nil {
+			log.Printf("signal watchdog: restored scan failed: %v", err)
+		}
+		for _, p := range restored {
+			log.Printf("driver signal restored on trip %s", p.TripID)
+			hub.BroadcastToTrip(p.TripID, SocketResponse{Event: "driver_signal_restored", Payload: p})
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const sosEscalationScan = 15 * time.Second
+
+// raiseSOS records an incident for a participant of an ongoing trip, alerts
+// the room and the outbound channels. Raising again while the user's last
+// incident is still open returns that incident without alerting again.
+func raiseSOS(ctx context.Context, tripID, userID, role, note string, lat, lng *float64) (sosIncident, error) {
+	// The snapshot reads live_trips / live_users, so write the reporter's
+	// buffered position first. A failure here must not block the alert.
+	var flushErr error
+	if role == "driver" {
+		flushErr = liveLocations.FlushTrip(ctx, tripID)
+	} else {
+		flushErr = liveLocations.FlushRider(ctx, userID)
+	}
+	if flushErr != nil {
+		log.Printf("SOS on trip %s: live location flush failed: %v", tripID, flushErr)
+	}
+
+	inc, created, err := createIncident(ctx, tripID, userID, role, note, lat, lng)
+	if err != nil {
+		return sosIncident{}, err
+	}
+	if !created {
+		return inc, nil
+	}
+
+	log.Printf("SOS incident %s raised by %s %s on trip %s", inc.IncidentID, role, userID, tripID)
+	hub.BroadcastToTrip(tripID, SocketResponse{Event: "sos_alert", Payload: inc.alertPayload()})
+	dispatchSOS("sos_raised", inc)
+	return inc, nil
+}
+
+func acknowledgeSOS(ctx context.Context, incidentID, by string) error {
+	tripID, at, err := acknowledgeIncident(ctx, incidentID, by)
+	if err != nil {
+		return err
+	}
+	log.Printf("SOS incident %s acknowledged by %s", incidentID, by)
+	hub.BroadcastToTrip(tripID, SocketResponse{
+		Event: "sos_acknowledged",
+		Payload: SOSAcknowledgedPayload{
+			IncidentID:     incidentID,
+			TripID:         tripID,
+			AcknowledgedAt: at.UTC().Format(time.RFC3339),
+		},
+	})
+	return nil
+}
+
+// runSOSEscalation re-alerts every channel for incidents left open longer
+// than cfg.SOSEscalateAfter, up to cfg.SOSMaxEscalations times.
+func runSOSEscalation(ctx context.Context) {
+	ticker := time.NewTicker(sosEscalationScan)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		scanCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		ids, err := claimIncidentsForEscalation(scanCtx, cfg.SOSEscalateAfter, cfg.SOSMaxEscalations)
+		if err != nil {
+			log.Printf("SOS escalation scan failed: %v", err)
+		}
+		for _, id := range ids {
+			inc, err := getIncident(scanCtx, id)
+			if err != nil {
+				log.Printf("SOS escalation: load incident %s: %v", id, err)
+				continue
+			}
+			log.Printf("SOS incident %s unacknowledged, escalation %d", id, inc.EscalationLevel)
+			dispatchSOS("sos_escalated", inc)
+		}
+		cancel()
+	}
+}
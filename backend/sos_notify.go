@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// SOS alerts leave the system through every configured sosNotifier. Each
+// one is tried independently; a failed delivery is retried by the next
+// escalation.
+
+type sosNotifier interface {
+	name() string
+	notify(ctx context.Context, kind string, inc sosIncident) error
+}
+
+var sosNotifiers []sosNotifier
+
+// loadSOSNotifiers builds the outbound channels from the environment:
+//
+//	SOS_WEBHOOK_URL, SOS_WEBHOOK_SECRET
+//	SOS_SMTP_ADDR, SOS_SMTP_USER, SOS_SMTP_PASSWORD, SOS_SMTP_FROM, SOS_SMTP_TO
+//	SOS_SMS_TO
+func loadSOSNotifiers() []sosNotifier {
+	var notifiers []sosNotifier
+
+	if url := strings.TrimSpace(os.Getenv("SOS_WEBHOOK_URL")); url != "" {
+		notifiers = append(notifiers, &webhookNotifier{
+			url:    url,
+			secret: os.Getenv("SOS_WEBHOOK_SECRET"),
+			client: &http.Client{Timeout: 10 * time.Second},
+		})
+	}
+
+	if addr := strings.TrimSpace(os.Getenv("SOS_SMTP_ADDR")); addr != "" {
+		to := splitList(os.Getenv("SOS_SMTP_TO"))
+		from := strings.TrimSpace(os.Getenv("SOS_SMTP_FROM"))
+		if len(to) == 0 || from == "" {
+			log.Println("SOS_SMTP_ADDR is set but SOS_SMTP_FROM or SOS_SMTP_TO is missing; email alerts disabled")
+		} else {
+			n := &smtpNotifier{addr: addr, from: from, to: to}
+			if user := os.Getenv("SOS_SMTP_USER"); user != "" {
+				host, _, _ := net.SplitHostPort(addr)
+				n.auth = smtp.PlainAuth("", user, os.Getenv("SOS_SMTP_PASSWORD"), host)
+			}
+			notifiers = append(notifiers, n)
+		}
+	}
+
+	// No SMS provider is wired in yet; the log sender stands in for one so
+	// the channel can be exercised end to end.
+	if to := splitList(os.Getenv("SOS_SMS_TO")); len(to) > 0 {
+		notifiers = append(notifiers, &smsNotifier{sender: logSMSSender{}, to: to})
+	}
+
+	if len(notifiers) == 0 {
+		log.Println("No SOS channels configured; alerts will only reach the trip room")
+	}
+	for _, n := range notifiers {
+		log.Printf("SOS channel enabled: %s", n.name())
+	}
+	return notifiers
+}
+
+// dispatchSOS hands inc to every channel in the background.
+func dispatchSOS(kind string, inc sosIncident) {
+	for _, n := range sosNotifiers {
+		go func(n sosNotifier) {
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			defer cancel()
+			if err := n.notify(ctx, kind, inc); err != nil {
+				log.Printf("SOS %s for incident %s via %s failed: %v", kind, inc.IncidentID, n.name(), err)
+			}
+		}(n)
+	}
+}
+
+func sosSummary(kind string, inc sosIncident) string {
+	var b strings.Builder
+	if kind == "sos_escalated" {
+		fmt.Fprintf(&b, "SOS UNACKNOWLEDGED (escalation %d): ", inc.EscalationLevel)
+	} else {
+		b.WriteString("SOS: ")
+	}
+	fmt.Fprintf(&b, "%s (%s) on trip %s", inc.RaisedByName, inc.RaisedByRole, inc.TripID)
+	if inc.Lat != nil && inc.Lng != nil {
+		fmt.Fprintf(&b, " at https://maps.google.com/?q=%.6f,%.6f (%s", *inc.Lat, *inc.Lng, inc.LocationSource)
+		if inc.LocationAt != "" {
+			fmt.Fprintf(&b, ", %s", inc.LocationAt)
+		}
+		b.WriteString(")")
+	} else {
+		b.WriteString(", position unknown")
+	}
+	var details struct {
+		Vehicle struct {
+			Number string `json:"number"`
+			Type   string `json:"type"`
+		} `json:"vehicle"`
+	}
+	if json.Unmarshal(inc.Details, &details) == nil && details.Vehicle.Number != "" {
+		fmt.Fprintf(&b, ". Vehicle %s %s", details.Vehicle.Type, details.Vehicle.Number)
+	}
+	if inc.Note != "" {
+		fmt.Fprintf(&b, ". Note: %s", inc.Note)
+	}
+	fmt.Fprintf(&b, ". Incident %s", inc.IncidentID)
+	return b.String()
+}
+
+type webhookNotifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (n *webhookNotifier) name() string { return "webhook" }
+
+func (n *webhookNotifier) notify(ctx context.Context, kind string, inc sosIncident) error {
+	return n.post(ctx, map[string]interface{}{"event": kind, "incident": inc})
+}
+
+// post sends v as JSON. With a secret set the body is signed with
+// HMAC-SHA256 in X-Yatra-Signature.
+func (n *webhookNotifier) post(ctx context.Context, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write(body)
+		req.Header.Set("X-Yatra-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+type smtpNotifier struct {
+	addr string
+	auth smtp.Auth
+	from string
+	to   []string
+}
+
+func (n *smtpNotifier) name() string { return "smtp" }
+
+func (n *smtpNotifier) notify(ctx context.Context, kind string, inc sosIncident) error {
+	subject := "SOS on trip " + inc.TripID
+	if kind == "sos_escalated" {
+		subject = fmt.Sprintf("[ESCALATION %d] %s", inc.EscalationLevel, subject)
+	}
+	details, _ := json.MarshalIndent(inc, "", "  ")
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(sosSummary(kind, inc))
+	msg.WriteString("\r\n\r\n")
+	msg.Write(details)
+	msg.WriteString("\r\n")
+
+	// net/smtp takes no context, so the deadline only bounds how long we wait.
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(n.addr, n.auth, n.from, n.to, msg.Bytes()) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// smsSender is the seam for an SMS provider.
+type smsSender interface {
+	SendSMS(ctx context.Context, to, body string) error
+}
+
+// logSMSSender is the local fake: it writes the message to the log.
+type logSMSSender struct{}
+
+func (logSMSSender) SendSMS(ctx context.Context, to, body string) error {
+	log.Printf("[sms to %s] %s", to, body)
+	return nil
+}
+
+type smsNotifier struct {
+	sender smsSender
+	to     []string
+}
+
+func (n *smsNotifier) name() string { return "sms" }
+
+func (n *smsNotifier) notify(ctx context.Context, kind string, inc sosIncident) error {
+	body := sosSummary(kind, inc)
+	var firstErr error
+	for _, to := range n.to {
+		if err := n.sender.SendSMS(ctx, to, body); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("sms to %s: %w", to, err)
+		}
+	}
+	return firstErr
+}
+
+func splitList(raw string) []string {
+	var out []string
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Breadcrumb exports. Each format carries every recorded point with its
+// timestamp; heading and speed go wherever the format has room for them.
+
+var traceFormats = map[string]struct {
+	contentType string
+	encode      func(w io.Writer, tripID string, points []tracePoint) error
+}{
+	"gpx":     {"application/gpx+xml", encodeTraceGPX},
+	"geojson": {"application/geo+json", encodeTraceGeoJSON},
+	"kml":     {"application/vnd.google-earth.kml+xml", encodeTraceKML},
+}
+
+type gpxDoc struct {
+	XMLName xml.Name `xml:"gpx"`
+	Version string   `xml:"version,attr"`
+	Creator string   `xml:"creator,attr"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	XmlnsTP string   `xml:"xmlns:gpxtpx,attr"`
+	Track   gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name    string     `xml:"name"`
+	Segment []gpxPoint `xml:"trkseg>trkpt"`
+}
+
+type gpxPoint struct {
+	Lat        float64        `xml:"lat,attr"`
+	Lon        float64        `xml:"lon,attr"`
+	Time       string         `xml:"time"`
+	Extensions *gpxExtensions `xml:"extensions,omitempty"`
+}
+
+// gpxExtensions holds speed in m/s and course in degrees, which GPX 1.1
+// dropped from trkpt, in Garmin's TrackPointExtension.
+type gpxExtensions struct {
+	Speed  *float64 `xml:"gpxtpx:TrackPointExtension>gpxtpx:speed,omitempty"`
+	Course *float64 `xml:"gpxtpx:TrackPointExtension>gpxtpx:course,omitempty"`
+}
+
+func encodeTraceGPX(w io.Writer, tripID string, points []tracePoint) error {
+	doc := gpxDoc{
+		Version: "1.1",
+		Creator: "YatraSathi",
+		Xmlns:   "http://www.topografix.com/GPX/1/1",
+		XmlnsTP: "http://www.garmin.com/xmlschemas/TrackPointExtension/v2",
+		Track:   gpxTrack{Name: "Trip " + tripID},
+	}
+	for _, p := range points {
+		pt := gpxPoint{Lat: p.Lat, Lon: p.Lng, Time: p.RecordedAt.UTC().Format(time.RFC3339)}
+		if p.Heading != nil || p.SpeedKmph != nil {
+			pt.Extensions = &gpxExtensions{Course: p.Heading}
+			if p.SpeedKmph != nil {
+				ms := *p.SpeedKmph / 3.6
+				pt.Extensions.Speed = &ms
+			}
+		}
+		doc.Track.Segment = append(doc.Track.Segment, pt)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
+
+// encodeTraceGeoJSON writes one LineString feature. Per-point times,
+// headings and speeds are parallel arrays in its properties, following the
+// coordTimes convention most GeoJSON tools understand.
+func encodeTraceGeoJSON(w io.Writer, tripID string, points []tracePoint) error {
+	coords := make([][2]float64, 0, len(points))
+	times := make([]string, 0, len(points))
+	headings := make([]*float64, 0, len(points))
+	speeds := make([]*float64, 0, len(points))
+	for _, p := range points {
+		coords = append(coords, [2]float64{p.Lng, p.Lat})
+		times = append(times, p.RecordedAt.UTC().Format(time.RFC3339))
+		headings = append(headings, p.Heading)
+		speeds = append(speeds, p.SpeedKmph)
+	}
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"type": "FeatureCollection",
+		"features": []interface{}{
+			map[string]interface{}{
+				"type":     "Feature",
+				"geometry": map[string]interface{}{"type": "LineString", "coordinates": coords},
+				"properties": map[string]interface{}{
+					"tripId":     tripID,
+					"coordTimes": times,
+					"headings":   headings,
+					"speedsKmph": speeds,
+				},
+			},
+		},
+	})
+}
+
+type kmlDoc struct {
+	XMLName   xml.Name     `xml:"kml"`
+	Xmlns     string       `xml:"xmlns,attr"`
+	XmlnsGx   string       `xml:"xmlns:gx,attr"`
+	Placemark kmlPlacemark `xml:"Document>Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name  string   `xml:"name"`
+	Track kmlTrack `xml:"gx:Track"`
+}
+
+type kmlTrack struct {
+	When  []string `xml:"when"`
+	Coord []string `xml:"gx:coord"`
+}
+
+// encodeTraceKML writes a gx:Track, which keeps a timestamp per point.
+func encodeTraceKML(w io.Writer, tripID string, points []tracePoint) error {
+	doc := kmlDoc{
+		Xmlns:     "http://www.opengis.net/kml/2.2",
+		XmlnsGx:   "http://www.google.com/kml/ext/2.2",
+		Placemark: kmlPlacemark{Name: "Trip " + tripID},
+	}
+	for _, p := range points {
+		doc.Placemark.Track.When = append(doc.Placemark.Track.When, p.RecordedAt.UTC().Format(time.RFC3339))
+		doc.Placemark.Track.Coord = append(doc.Placemark.Track.Coord, fmt.Sprintf("%f %f 0", p.Lng, p.Lat))
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
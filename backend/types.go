@@ -8,19 +8,51 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// Message is an inbound frame. ID is optional and chosen by the client; it
+// is echoed on every direct reply to that frame.
 type Message struct {
+	ID      string          `json:"id,omitempty"`
 	Event   string          `json:"event"`
 	Payload json.RawMessage `json:"payload"`
 }
 
 type SocketResponse struct {
+	ID      string      `json:"id,omitempty"`
 	Event   string      `json:"event"`
 	Payload interface{} `json:"payload"`
+	TripID  string      `json:"tripId,omitempty"`
+	Seq     uint64      `json:"seq,omitempty"`
+	// Replay marks frames from a trip replay rather than the live room.
+	Replay bool `json:"replay,omitempty"`
+}
+
+const (
+	errCodeInvalidMessage = "invalid_message"
+	errCodeUnknownEvent   = "unknown_event"
+	errCodeInvalidPayload = "invalid_payload"
+	errCodeForbidden      = "forbidden"
+	errCodeNotJoined      = "not_joined"
+	errCodeNotFound       = "not_found"
+	errCodeUpdateFailed   = "update_failed"
+	errCodeRateLimited    = "rate_limited"
+	errCodeBadPosition    = "position_rejected"
+
+	errCodeUnsupportedVersion = "unsupported_version"
+)
+
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type AckPayload struct {
+	Event string `json:"event"`
 }
 
 type JoinTripPayload struct {
@@ -28,6 +60,10 @@ type JoinTripPayload struct {
 	Role   string `json:"role"`
 }
 
+type UnsubscribePayload struct {
+	TripID string `json:"tripId"`
+}
+
 type LocationUpdatePayload struct {
 	TripID    string   `json:"tripId"`
 	Lat       float64  `json:"lat"`
@@ -42,35 +78,213 @@ type RiderActionPayload struct {
 	Action    string `json:"action"`
 }
 
+type ResumePayload struct {
+	TripID  string `json:"tripId"`
+	LastSeq uint64 `json:"lastSeq"`
+	Epoch   string `json:"epoch"`
+}
+
 type TripActionPayload struct {
 	TripID string `json:"tripId"`
 	Action string `json:"action"`
 }
 
+type SOSPayload struct {
+	TripID string   `json:"tripId"`
+	Note   string   `json:"note,omitempty"`
+	Lat    *float64 `json:"lat,omitempty"`
+	Lng    *float64 `json:"lng,omitempty"`
+}
+
+type ReplayTripPayload struct {
+	TripID     string  `json:"tripId"`
+	Speed      float64 `json:"speed,omitempty"`
+	PositionMs int64   `json:"positionMs,omitempty"`
+	// StaffToken lets operations staff replay any trip; see
+	// REPLAY_STAFF_TOKEN.
+	StaffToken string `json:"staffToken,omitempty"`
+}
+
+type ReplayControlPayload struct {
+	TripID     string   `json:"tripId"`
+	Action     string   `json:"action"`
+	PositionMs *int64   `json:"positionMs,omitempty"`
+	Speed      *float64 `json:"speed,omitempty"`
+}
+
+type ChatSendPayload struct {
+	TripID      string `json:"tripId"`
+	Scope       string `json:"scope,omitempty"`
+	RecipientID string `json:"recipientId,omitempty"`
+	Body        string `json:"body"`
+}
+
+const (
+	sendQueueSize  = 64
+	writeWait      = 10 * time.Second
+	pongWait       = 60 * time.Second
+	pingPeriod     = (pongWait * 9) / 10
+	maxMessageSize = 8192
+
+	closeCodeSlowConsumer = 4001
+	closeCodeShareEnded   = 4002
+)
+
+// Client is one WebSocket connection. It can be subscribed to several trip
+// rooms at once; subscriptions maps trip ID to what the client was
+// authorized as in that room and is guarded by the hub lock.
 type Client struct {
-	conn   *websocket.Conn
-	userID string
-	tripID string
-	role   string
-	mu     sync.Mutex
+	conn          *websocket.Conn
+	userID        string
+	subscriptions map[string]*tripAuth
+
+	// Spectators connect with a share link instead of an account; userID is
+	// empty and they may only follow shareTripID.
+	shareID     string
+	shareTripID string
+
+	limiter         *connLimiter
+	protocolVersion int
+
+	replayMu sync.Mutex
+	replays  map[string]*replaySession
+
+	send      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	closeCode int
+	closeMsg  string
+}
+
+func newClient(conn *websocket.Conn, userID string) *Client {
+	return &Client{
+		conn:          conn,
+		userID:        userID,
+		subscriptions: make(map[string]*tripAuth),
+		limiter:       newConnLimiter(),
+		replays:       make(map[string]*replaySession),
+		send:          make(chan []byte, sendQueueSize),
+		done:          make(chan struct{}),
+	}
 }
 
 func (c *Client) writeJSON(v interface{}) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if err := c.conn.WriteJSON(v); err != nil {
-		log.Printf("write error for user %s: %v", c.userID, err)
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("marshal error for %s: %v", c.logID(), err)
+		return
+	}
+	c.enqueue(data)
+}
+
+func (c *Client) logID() string {
+	if c.shareID != "" {
+		return "Spectator " + c.shareID
+	}
+	return "User " + c.userID
+}
+
+// reply sends a direct response to req, carrying its ID when it had one.
+func (c *Client) reply(req Message, resp SocketResponse) {
+	resp.ID = req.ID
+	c.writeJSON(resp)
+}
+
+func (c *Client) replyError(req Message, code, message string) {
+	c.reply(req, SocketResponse{Event: "error", Payload: ErrorPayload{Code: code, Message: message}})
+}
+
+// ack confirms a fire-and-forget event. Clients opt in by giving the frame
+// an ID.
+func (c *Client) ack(req Message) {
+	if req.ID == "" {
+		return
+	}
+	c.reply(req, SocketResponse{Event: "ack", Payload: AckPayload{Event: req.Event}})
+}
+
+// enqueue never blocks: a client whose queue is full is disconnected
+// instead of stalling the goroutine that is broadcasting.
+func (c *Client) enqueue(data []byte) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	select {
+	case c.send <- data:
+	default:
+		log.Printf("send queue full for %s, disconnecting", c.logID())
+		c.close(closeCodeSlowConsumer, "slow consumer")
+	}
+}
+
+func (c *Client) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeMsg = reason
+		close(c.done)
+	})
+}
+
+func (c *Client) writer() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		_ = c.conn.Close()
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				log.Printf("ping error for %s: %v", c.logID(), err)
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case data := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Printf("write error for %s: %v", c.logID(), err)
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-c.done:
+			msg := websocket.FormatCloseMessage(c.closeCode, c.closeMsg)
+			_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+			return
+		}
 	}
 }
 
 type Hub struct {
-	mu    sync.RWMutex
-	rooms map[string]map[*Client]bool
+	mu       sync.RWMutex
+	rooms    map[string]map[*Client]string
+	history  map[string]*roomHistory
+	presence map[string]map[string]*presenceEntry
+	filters  map[string]*roomFilters
+
+	// presenceSeen is when each peer instance was last heard from.
+	presenceSeen map[string]time.Time
+
+	instanceID string
+	outbox     chan hubNotification
+
+	clients  map[*Client]bool
+	draining bool
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		rooms: make(map[string]map[*Client]bool),
+		rooms:        make(map[string]map[*Client]string),
+		history:      make(map[string]*roomHistory),
+		presence:     make(map[string]map[string]*presenceEntry),
+		filters:      make(map[string]*roomFilters),
+		presenceSeen: make(map[string]time.Time),
+		instanceID:   newInstanceID(),
+		outbox:       make(chan hubNotification, hubOutboxSize),
+		clients:      make(map[*Client]bool),
 	}
 }
 
@@ -78,39 +292,74 @@ func (h *Hub) EnsureRoom(tripID string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	if _, ok := h.rooms[tripID]; !ok {
-		h.rooms[tripID] = make(map[*Client]bool)
+		h.rooms[tripID] = make(map[*Client]string)
 	}
 }
 
-func (h *Hub) JoinRoom(c *Client, tripID string) {
+// JoinRoom subscribes c to the room as auth, keeping any other
+// subscriptions it has. It returns the room's current sequence number and
+// epoch, which the client hands back in a later resume.
+func (h *Hub) JoinRoom(c *Client, tripID string, auth tripAuth) (uint64, string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	return h.joinRoomLocked(c, tripID, auth)
+}
 
-	if c.tripID != "" && c.tripID != tripID {
-		h.removeFromRoomLocked(c, c.tripID)
+func (h *Hub) joinRoomLocked(c *Client, tripID string, auth tripAuth) (uint64, string) {
+	if _, ok := h.rooms[tripID]; !ok {
+		h.rooms[tripID] = make(map[*Client]string)
+	}
+	_, rejoin := h.rooms[tripID][c]
+	h.rooms[tripID][c] = auth.Role
+	c.subscriptions[tripID] = &auth
+	if !rejoin {
+		h.trackPresenceLocked(tripID, c.userID, auth.Role, 1)
 	}
 
-	if _, ok := h.rooms[tripID]; !ok {
-		h.rooms[tripID] = make(map[*Client]bool)
+	h.pruneHistoryLocked(time.Now())
+	hist := h.historyLocked(tripID)
+	return hist.seq, hist.epoch
+}
+
+// RoleIn reports the role c holds in the room, if it is subscribed.
+func (h *Hub) RoleIn(c *Client, tripID string) (string, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	auth, ok := c.subscriptions[tripID]
+	if !ok {
+		return "", false
+	}
+	return auth.Role, true
+}
+
+func (h *Hub) LeaveRoom(c *Client, tripID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := c.subscriptions[tripID]; !ok {
+		return false
 	}
-	h.rooms[tripID][c] = true
-	c.tripID = tripID
+	h.removeFromRoomLocked(c, tripID)
+	return true
 }
 
+// Leave drops every subscription c holds.
 func (h *Hub) Leave(c *Client) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	if c.tripID != "" {
-		h.removeFromRoomLocked(c, c.tripID)
-		c.tripID = ""
+	for tripID := range c.subscriptions {
+		h.removeFromRoomLocked(c, tripID)
 	}
 }
 
 func (h *Hub) removeFromRoomLocked(c *Client, tripID string) {
+	delete(c.subscriptions, tripID)
 	room, ok := h.rooms[tripID]
 	if !ok {
 		return
 	}
+	if role, member := room[c]; member {
+		h.trackPresenceLocked(tripID, c.userID, role, -1)
+	}
 	delete(room, c)
 	if len(room) == 0 {
 		delete(h.rooms, tripID)
@@ -118,36 +367,126 @@ func (h *Hub) removeFromRoomLocked(c *Client, tripID string) {
 }
 
 func (h *Hub) BroadcastToTrip(tripID string, msg SocketResponse) {
-	h.mu.RLock()
-	room := h.rooms[tripID]
-	clients := make([]*Client, 0, len(room))
-	for c := range room {
-		clients = append(clients, c)
+	h.BroadcastToTripRole(tripID, "", msg)
+}
+
+// BroadcastToTripRole delivers msg to the local clients in the room holding
+// role (every client when role is empty) and relays it to other instances.
+func (h *Hub) BroadcastToTripRole(tripID, role string, msg SocketResponse) {
+	payload, err := json.Marshal(msg.Payload)
+	if err != nil {
+		log.Printf("marshal error for trip %s: %v", tripID, err)
+		return
 	}
-	h.mu.RUnlock()
 
-	for _, c := range clients {
-		c.writeJSON(msg)
+	h.deliverLocal(tripID, audience{role: role}, msg.Event, payload)
+	h.publish(hubNotification{Kind: "broadcast", TripID: tripID, Role: role, Event: msg.Event, Data: payload})
+}
+
+// SendToTripUsers delivers msg only to the given users' connections in the
+// room, on every instance.
+func (h *Hub) SendToTripUsers(tripID string, userIDs []string, msg SocketResponse) {
+	if len(userIDs) == 0 {
+		return
 	}
+	payload, err := json.Marshal(msg.Payload)
+	if err != nil {
+		log.Printf("marshal error for trip %s: %v", tripID, err)
+		return
+	}
+
+	h.deliverLocal(tripID, audience{users: userIDs}, msg.Event, payload)
+	h.publish(hubNotification{Kind: "broadcast", TripID: tripID, Users: userIDs, Event: msg.Event, Data: payload})
 }
 
-func (h *Hub) BroadcastToTripRole(tripID, role string, msg SocketResponse) {
-	h.mu.RLock()
-	room := h.rooms[tripID]
-	clients := make([]*Client, 0, len(room))
-	for c := range room {
-		if c.role == role {
-			clients = append(clients, c)
+// RevokeShare disconnects every spectator using the share link.
+func (h *Hub) RevokeShare(tripID, shareID string) {
+	h.revokeShareLocal(tripID, shareID)
+	h.publish(hubNotification{Kind: "revoke_share", TripID: tripID, ShareID: shareID})
+}
+
+func (h *Hub) revokeShareLocal(tripID, shareID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.rooms[tripID] {
+		if c.shareID == shareID {
+			h.removeFromRoomLocked(c, tripID)
+			c.close(closeCodeShareEnded, "share link revoked")
 		}
 	}
-	h.mu.RUnlock()
+}
+
+func (h *Hub) CloseRoom(tripID string) {
+	h.closeRoomLocal(tripID)
+	h.publish(hubNotification{Kind: "close", TripID: tripID})
+}
+
+// spectatorEvents are the only room events relayed to share-link viewers;
+// none of them carry rider details.
+var spectatorEvents = map[string]bool{
+	"driver_location_updated": true,
+	"trip_started":            true,
+	"trip_completed":          true,
+	"driver_signal_lost":      true,
+	"driver_signal_restored":  true,
+	"server_restarting":       true,
+}
+
+// audience narrows a room message to one role and/or a set of users; the
+// zero value reaches everyone in the room.
+type audience struct {
+	role  string
+	users []string
+}
+
+func canReceive(clientRole, clientUserID string, to audience, event string) bool {
+	if to.role != "" && clientRole != to.role {
+		return false
+	}
+	if to.users != nil && !containsString(to.users, clientUserID) {
+		return false
+	}
+	if clientRole == "spectator" {
+		return spectatorEvents[event]
+	}
+	return true
+}
+
+// deliverLocal stamps the message with the room's next sequence number,
+// records it for replay and queues it for the matching local clients. It
+// holds the hub lock throughout so every client sees sequence numbers in
+// order.
+func (h *Hub) deliverLocal(tripID string, to audience, event string, payload json.RawMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.deliverLocalLocked(tripID, to, event, payload)
+}
+
+func (h *Hub) deliverLocalLocked(tripID string, to audience, event string, payload json.RawMessage) {
+	hist := h.historyLocked(tripID)
+	seq := hist.seq + 1
+	data, err := json.Marshal(SocketResponse{Event: event, Payload: payload, TripID: tripID, Seq: seq})
+	if err != nil {
+		log.Printf("marshal error for trip %s: %v", tripID, err)
+		return
+	}
+	hist.seq = seq
+	hist.append(historyEntry{seq: seq, to: to, event: event, data: data})
 
-	for _, c := range clients {
-		c.writeJSON(msg)
+	for c, clientRole := range h.rooms[tripID] {
+		if canReceive(clientRole, c.userID, to, event) {
+			c.enqueue(data)
+		}
 	}
 }
 
-func (h *Hub) CloseRoom(tripID string) {
+func (h *Hub) closeRoomLocal(tripID string) {
+	// Location state is kept by whichever instance the driver's socket is
+	// on, so every instance drops its own when the room closes.
+	driverLocations.Forget(tripID)
+	liveLocations.ForgetTrip(tripID)
+	driverFixChecks.Forget(tripID)
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
@@ -156,13 +495,17 @@ func (h *Hub) CloseRoom(tripID string) {
 		return
 	}
 
-	for c := range room {
-		if c.tripID == tripID {
-			c.tripID = ""
+	for c, role := range room {
+		delete(c.subscriptions, tripID)
+		if role == "spectator" {
+			c.close(closeCodeShareEnded, "trip ended")
 		}
 	}
 
 	delete(h.rooms, tripID)
+	delete(h.history, tripID)
+	delete(h.presence, tripID)
+	delete(h.filters, tripID)
 }
 
 var upgrader = websocket.Upgrader{
@@ -195,3 +538,8 @@ var upgrader = websocket.Upgrader{
 
 var dbPool *pgxpool.Pool
 var hub = NewHub()
+var driverLocations = newLocationCoalescer(flushDriverFix)
+var liveLocations = newLocationWriter()
+var geofences = newGeofenceTracker()
+var routeMonitors = newRouteMonitor()
+var driverFixChecks = newFixChecker(checkDriverFix, forgetDriverFixChecks)
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// Outbound payloads. Everything sent over the socket uses one of these so
+// the catalogue stays the single description of the protocol.
+
+type HelloPayload struct {
+	ProtocolVersion    int `json:"protocolVersion"`
+	MinProtocolVersion int `json:"minProtocolVersion"`
+	MaxProtocolVersion int `json:"maxProtocolVersion"`
+}
+
+type SubscribedPayload struct {
+	TripID   string                `json:"tripId"`
+	Role     string                `json:"role"`
+	Seq      uint64                `json:"seq"`
+	Epoch    string                `json:"epoch"`
+	Presence []PresenceParticipant `json:"presence"`
+}
+
+type UnsubscribedPayload struct {
+	TripID string `json:"tripId"`
+}
+
+type ResumeResultPayload struct {
+	TripID   string `json:"tripId"`
+	Role     string `json:"role"`
+	Replayed int    `json:"replayed"`
+	Seq      uint64 `json:"seq"`
+	Epoch    string `json:"epoch"`
+}
+
+type DriverLocationPayload struct {
+	TripID     string   `json:"tripId"`
+	Lat        float64  `json:"lat"`
+	Lng        float64  `json:"lng"`
+	Heading    *float64 `json:"heading"`
+	SpeedKmph  *float64 `json:"speedKmph"`
+	UpdatedAt  string   `json:"updatedAt"`
+	SourceRole string   `json:"sourceRole"`
+}
+
+// RouteProgressPayload places the driver on the planned route. Off the
+// route (onRoute false) the snapped position is the reported one and
+// progress stays where the driver left the route. At is when the fix it
+// was computed from arrived.
+type RouteProgressPayload struct {
+	TripID             string  `json:"tripId"`
+	SnappedLat         float64 `json:"snappedLat"`
+	SnappedLng         float64 `json:"snappedLng"`
+	OnRoute            bool    `json:"onRoute"`
+	Progress           float64 `json:"progress"`
+	DistanceTravelledM float64 `json:"distanceTravelledM"`
+	DistanceRemainingM float64 `json:"distanceRemainingM"`
+	At                 string  `json:"at"`
+}
+
+type RiderLocationPayload struct {
+	TripID     string  `json:"tripId"`
+	RequestID  string  `json:"requestId"`
+	RiderName  string  `json:"riderName"`
+	Lat        float64 `json:"lat"`
+	Lng        float64 `json:"lng"`
+	Status     string  `json:"status"`
+	UpdatedAt  string  `json:"updatedAt"`
+	SourceRole string  `json:"sourceRole"`
+}
+
+type RiderActionValidationPayload struct {
+	TripID    string `json:"tripId"`
+	RequestID string `json:"requestId"`
+	Action    string `json:"action"`
+	Allowed   bool   `json:"allowed"`
+	Reason    string `json:"reason"`
+}
+
+type TripActionValidationPayload struct {
+	TripID  string `json:"tripId"`
+	Action  string `json:"action"`
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+}
+
+type TripStatusPayload struct {
+	TripID string `json:"tripId"`
+	Status string `json:"status"`
+}
+
+type RiderStatusPayload struct {
+	TripID    string `json:"tripId"`
+	RequestID string `json:"requestId"`
+	Status    string `json:"status"`
+	// Fare is set on rider_dropped_off for trips priced by distance.
+	Fare *FareBreakdownPayload `json:"fare,omitempty"`
+}
+
+// FareBreakdownPayload explains a distance-priced fare. Adjustment is
+// minimum or maximum when a bound was applied, and no_trace when the
+// onboard distance could not be measured and the quote was kept.
+type FareBreakdownPayload struct {
+	Mode             string  `json:"mode"`
+	QuotedFare       float64 `json:"quotedFare"`
+	FinalFare        float64 `json:"finalFare"`
+	PlannedDistanceM float64 `json:"plannedDistanceM"`
+	OnboardDistanceM float64 `json:"onboardDistanceM"`
+	DistanceRatio    float64 `json:"distanceRatio"`
+	MinFare          float64 `json:"minFare"`
+	MaxFare          float64 `json:"maxFare"`
+	RoundTo          float64 `json:"roundTo"`
+	Adjustment       string  `json:"adjustment,omitempty"`
+}
+
+type PresenceEventPayload struct {
+	TripID string `json:"tripId"`
+	UserID string `json:"userId"`
+	Role   string `json:"role"`
+}
+
+type ChatMessagePayload struct {
+	TripID      string `json:"tripId"`
+	MessageID   string `json:"messageId"`
+	SenderID    string `json:"senderId"`
+	SenderName  string `json:"senderName"`
+	SenderRole  string `json:"senderRole"`
+	Scope       string `json:"scope"`
+	RecipientID string `json:"recipientId,omitempty"`
+	Body        string `json:"body"`
+	SentAt      string `json:"sentAt"`
+}
+
+type GeofenceEventPayload struct {
+	TripID    string  `json:"tripId"`
+	Target    string  `json:"target"`
+	RequestID string  `json:"requestId,omitempty"`
+	StopID    string  `json:"stopId,omitempty"`
+	Address   string  `json:"address"`
+	DistanceM float64 `json:"distanceM"`
+	At        string  `json:"at"`
+}
+
+// StopEventPayload reports a trip stop being reached, left or skipped. At
+// is when that was recorded.
+type StopEventPayload struct {
+	TripID    string `json:"tripId"`
+	StopID    string `json:"stopId"`
+	StopOrder int    `json:"stopOrder"`
+	Address   string `json:"address"`
+	At        string `json:"at"`
+	// Reason is set on stop_skipped: later_stop_reached or trip_completed.
+	Reason string `json:"reason,omitempty"`
+}
+
+// DriverSignalPayload carries the driver's last known position. AgeSeconds
+// is how old that position was when the event was sent. A driver who never
+// sent one has no position or lastSeenAt, and AgeSeconds counts from the
+// trip start.
+type DriverSignalPayload struct {
+	TripID     string   `json:"tripId"`
+	Lat        *float64 `json:"lat"`
+	Lng        *float64 `json:"lng"`
+	Heading    *float64 `json:"heading"`
+	SpeedKmph  *float64 `json:"speedKmph"`
+	LastSeenAt string   `json:"lastSeenAt,omitempty"`
+	AgeSeconds float64  `json:"ageSeconds"`
+	LostAt     string   `json:"lostAt"`
+}
+
+type RouteDeviationPayload struct {
+	TripID       string  `json:"tripId"`
+	DistanceM    float64 `json:"distanceM"`
+	Progress     float64 `json:"progress"`
+	Lat          float64 `json:"lat"`
+	Lng          float64 `json:"lng"`
+	OffRouteFrom string  `json:"offRouteFrom"`
+	At           string  `json:"at"`
+}
+
+type SOSAlertPayload struct {
+	IncidentID     string   `json:"incidentId"`
+	TripID         string   `json:"tripId"`
+	RaisedBy       string   `json:"raisedBy"`
+	RaisedByName   string   `json:"raisedByName"`
+	RaisedByRole   string   `json:"raisedByRole"`
+	Lat            *float64 `json:"lat"`
+	Lng            *float64 `json:"lng"`
+	LocationSource string   `json:"locationSource"`
+	Note           string   `json:"note,omitempty"`
+	CreatedAt      string   `json:"createdAt"`
+}
+
+type SOSAcknowledgedPayload struct {
+	IncidentID     string `json:"incidentId"`
+	TripID         string `json:"tripId"`
+	AcknowledgedAt string `json:"acknowledgedAt"`
+}
+
+type ReplayStatePayload struct {
+	TripID     string  `json:"tripId"`
+	State      string  `json:"state"`
+	PositionMs int64   `json:"positionMs"`
+	DurationMs int64   `json:"durationMs"`
+	Speed      float64 `json:"speed"`
+	StartedAt  string  `json:"startedAt"`
+}
+
+type ServerRestartingPayload struct {
+	ReconnectAfterMs int `json:"reconnectAfterMs"`
+}
+
+// Inbound payload validation and room scoping.
+
+func (p *JoinTripPayload) validate() error {
+	if p.TripID == "" {
+		return errors.New("invalid join payload")
+	}
+	return nil
+}
+
+func (p *UnsubscribePayload) validate() error {
+	if p.TripID == "" {
+		return errors.New("invalid unsubscribe payload")
+	}
+	return nil
+}
+
+func (p *ResumePayload) validate() error {
+	if p.TripID == "" {
+		return errors.New("invalid resume payload")
+	}
+	return nil
+}
+
+func (p *LocationUpdatePayload) validate() error {
+	if p.TripID == "" {
+		return errors.New("invalid location payload")
+	}
+	// 0,0 is what a phone reports before it has a fix.
+	if !validCoordinates(p.Lat, p.Lng) || (p.Lat == 0 && p.Lng == 0) {
+		return errors.New("invalid coordinates")
+	}
+	return nil
+}
+
+func (p *LocationUpdatePayload) roomID() string { return p.TripID }
+
+func (p *RiderActionPayload) validate() error {
+	if p.TripID == "" || p.RequestID == "" {
+		return errors.New("invalid rider action payload")
+	}
+	return nil
+}
+
+func (p *TripActionPayload) validate() error {
+	if p.TripID == "" {
+		return errors.New("invalid trip action payload")
+	}
+	return nil
+}
+
+const maxSOSNoteRunes = 500
+
+func (p *SOSPayload) validate() error {
+	if p.TripID == "" {
+		return errors.New("invalid sos payload")
+	}
+	p.Note = strings.TrimSpace(p.Note)
+	if utf8.RuneCountInString(p.Note) > maxSOSNoteRunes {
+		return errors.New("sos note too long")
+	}
+	if (p.Lat == nil) != (p.Lng == nil) {
+		return errors.New("lat and lng must be sent together")
+	}
+	if p.Lat != nil && !validCoordinates(*p.Lat, *p.Lng) {
+		return errors.New("invalid coordinates")
+	}
+	return nil
+}
+
+func (p *SOSPayload) roomID() string { return p.TripID }
+
+const maxChatBodyRunes = 1000
+
+func (p *ChatSendPayload) validate() error {
+	p.Body = strings.TrimSpace(p.Body)
+	if p.TripID == "" || p.Body == "" {
+		return errors.New("invalid chat payload")
+	}
+	if utf8.RuneCountInString(p.Body) > maxChatBodyRunes {
+		return errors.New("chat message too long")
+	}
+	switch p.Scope {
+	case "":
+		p.Scope = "group"
+	case "group", "direct":
+	default:
+		return errors.New("scope must be group or direct")
+	}
+	if p.Scope == "group" && p.RecipientID != "" {
+		return errors.New("group messages have no recipient")
+	}
+	if p.RecipientID != "" && !validUUID(p.RecipientID) {
+		return errors.New("recipientId must be a UUID")
+	}
+	return nil
+}
+
+// validUUID accepts the canonical 8-4-4-4-12 hex form.
+func validUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, r := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if r != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (p *ChatSendPayload) roomID() string { return p.TripID }
+
+func validReplaySpeed(speed float64) bool {
+	return speed >= replayMinSpeed && speed <= replayMaxSpeed
+}
+
+func (p *ReplayTripPayload) validate() error {
+	if p.TripID == "" || p.PositionMs < 0 {
+		return errors.New("invalid replay payload")
+	}
+	if p.Speed != 0 && !validReplaySpeed(p.Speed) {
+		return errors.New("speed out of range")
+	}
+	return nil
+}
+
+func (p *ReplayControlPayload) validate() error {
+	if p.TripID == "" {
+		return errors.New("invalid replay control payload")
+	}
+	switch p.Action {
+	case "pause", "resume", "stop":
+	case "seek":
+		if p.PositionMs == nil || *p.PositionMs < 0 {
+			return errors.New("seek needs positionMs")
+		}
+	case "speed":
+		if p.Speed == nil || !validReplaySpeed(*p.Speed) {
+			return errors.New("speed out of range")
+		}
+	default:
+		return errors.New("action must be pause, resume, seek, speed or stop")
+	}
+	return nil
+}
+
+func init() {
+	onEvent("join_trip", eventMeta{
+		Summary: "Subscribe to a trip room (v1 name for subscribe).",
+		Replies: []string{"joined_trip", "error"},
+	}, func(c *Client, msg Message, p *JoinTripPayload) { handleSubscribe(c, msg, p, "joined_trip") })
+	onEvent("subscribe", eventMeta{
+		Summary:    "Subscribe to a trip room alongside any existing subscriptions.",
+		MinVersion: 2,
+		Replies:    []string{"subscribed", "error"},
+	}, func(c *Client, msg Message, p *JoinTripPayload) { handleSubscribe(c, msg, p, "subscribed") })
+	onEvent("unsubscribe", eventMeta{
+		Summary:    "Leave a trip room.",
+		MinVersion: 2,
+		Replies:    []string{"unsubscribed", "error"},
+	}, handleUnsubscribe)
+	onEvent("resume", eventMeta{
+		Summary:    "Rejoin a trip room and replay events after lastSeq.",
+		MinVersion: 2,
+		Replies:    []string{"resumed", "resync_required", "error"},
+	}, handleResume)
+	onEvent("location_update", eventMeta{
+		Summary: "Report the sender's current position. Acked when the frame has an id.",
+		Roles:   []string{"driver", "rider"},
+		Replies: []string{"ack", "error"},
+	}, handleLocationUpdate)
+	onEvent("rider_action", eventMeta{
+		Summary: "Ask whether the rider may mark themselves onboard or dropped off.",
+		Replies: []string{"rider_action_validation", "error"},
+	}, handleRiderActionValidation)
+	onEvent("trip_action", eventMeta{
+		Summary: "Ask whether the driver may act on the trip.",
+		Replies: []string{"trip_action_validation", "error"},
+	}, handleTripActionValidation)
+	onEvent("sos", eventMeta{
+		Summary: "Raise an emergency alert for the trip. lat/lng are used only when the server has no live position for the sender.",
+		Roles:   []string{"driver", "rider"},
+		Replies: []string{"ack", "error"},
+	}, handleSOS)
+	onEvent("chat_message", eventMeta{
+		Summary: "Send a chat message to the room (scope group) or between the driver and one rider (scope direct). Riders' direct messages go to the driver.",
+		Roles:   []string{"driver", "rider"},
+		Replies: []string{"ack", "error"},
+	}, handleChatMessage)
+	onEvent("replay_trip", eventMeta{
+		Summary:    "Replay a completed trip to this connection: breadcrumbs as driver_location_updated and lifecycle events, with replay set on every frame. speed defaults to 1, positionMs to the start. Drivers and riders of the trip only, or operations staff sending staffToken (REPLAY_STAFF_TOKEN); no room join needed.",
+		MinVersion: 2,
+		Replies:    []string{"replay_state", "error"},
+	}, handleReplayTrip)
+	onEvent("replay_control", eventMeta{
+		Summary:    "Pause, resume, seek (positionMs), change speed or stop a running replay.",
+		MinVersion: 2,
+		Replies:    []string{"replay_state", "error"},
+	}, handleReplayControl)
+
+	emits[HelloPayload]("hello", "Sent on connect with the negotiated protocol version.")
+	emits[ErrorPayload]("error", "Direct reply when a frame is rejected.")
+	emits[AckPayload]("ack", "Confirms a frame that carried an id.")
+	emits[SubscribedPayload]("joined_trip", "Reply to join_trip.")
+	emits[SubscribedPayload]("subscribed", "Reply to subscribe.")
+	emits[UnsubscribedPayload]("unsubscribed", "Reply to unsubscribe.")
+	emits[ResumeResultPayload]("resumed", "Missed events were replayed ahead of this reply.")
+	emits[ResumeResultPayload]("resync_required", "Missed events are gone; refetch the trip over HTTP.")
+	emits[DriverLocationPayload]("driver_location_updated", "Driver position, sent to the whole room.")
+	emits[RouteProgressPayload]("route_progress", "The driver's position snapped to the planned route and progress along it, sent to the whole room shortly after the driver_location_updated it was computed from. Trips without a route never get it.")
+	emits[RiderLocationPayload]("rider_location_updated", "Rider position, sent to the driver only.")
+	emits[RiderActionValidationPayload]("rider_action_validation", "Reply to rider_action.")
+	emits[TripActionValidationPayload]("trip_action_validation", "Reply to trip_action.")
+	emits[TripStatusPayload]("trip_started", "The driver started the trip.")
+	emits[TripStatusPayload]("trip_completed", "The driver completed the trip; the room closes after this.")
+	emits[RiderStatusPayload]("rider_onboard", "A rider was picked up.")
+	emits[RiderStatusPayload]("rider_dropped_off", "A rider was dropped off. On distance-priced trips fare carries the final fare and how it was reached.")
+	emits[PresenceEventPayload]("participant_joined", "A participant opened their first connection to the room.")
+	emits[PresenceEventPayload]("participant_left", "A participant closed their last connection to the room.")
+	emits[ChatMessagePayload]("chat_message", "A chat message, to the room or only to the two ends of a direct message.")
+	emits[GeofenceEventPayload]("driver_approaching", "The driver came within the approach radius of a pickup, drop or stop (target). Pickups and drops go to that rider and the driver only.")
+	emits[GeofenceEventPayload]("driver_arrived", "The driver reached a pickup, drop or stop.")
+	emits[GeofenceEventPayload]("driver_departed", "The driver left a pickup, drop or stop they had reached.")
+	emits[StopEventPayload]("stop_arrived", "The driver reached a trip stop for the first time.")
+	emits[StopEventPayload]("stop_departed", "The driver left a trip stop they had reached.")
+	emits[StopEventPayload]("stop_skipped", "A trip stop was passed over: a later stop was reached first, or the trip completed without reaching it. A skipped stop can still be reached later.")
+	emits[DriverSignalPayload]("driver_signal_lost", "No driver position has arrived for longer than the signal timeout.")
+	emits[DriverSignalPayload]("driver_signal_restored", "Driver positions are arriving again after driver_signal_lost.")
+	emits[RouteDeviationPayload]("route_deviation", "The driver has been off the planned route for a sustained period; sent to riders.")
+	emits[RouteDeviationPayload]("route_rejoined", "The driver is back on the planned route after a route_deviation.")
+	emits[SOSAlertPayload]("sos_alert", "A participant raised an SOS; sent to drivers and riders in the room.")
+	emits[SOSAcknowledgedPayload]("sos_acknowledged", "An operator acknowledged an SOS.")
+	emits[ReplayStatePayload]("replay_state", "Replay position and state (playing, paused, ended, stopped); also sent when a replay reaches the end.")
+	emits[ServerRestartingPayload]("server_restarting", "The server is shutting down; reconnect after the hint.")
+}
@@ -6,12 +6,38 @@ import (
 	"log"
 	"net/http"
 	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
 )
 
 func wsEndpoint(w http.ResponseWriter, r *http.Request) {
 	userID, err := verifyToken(r)
+	var share *shareClaims
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		shareToken := r.URL.Query().Get("share")
+		if shareToken == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		share, err = verifyShareToken(shareToken)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userID = ""
+	}
+
+	version, ok := negotiateProtocolVersion(r.URL.Query().Get("v"))
+	if !ok {
+		http.Error(w, "Unsupported protocol version", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if share != nil && !isTripShareLinkActive(ctx, share.ShareID, share.TripID) {
+		http.Error(w, "Share link expired", http.StatusUnauthorized)
 		return
 	}
 
@@ -21,29 +47,59 @@ func wsEndpoint(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := &Client{
-		conn:   ws,
-		userID: userID,
+	client := newClient(ws, userID)
+	client.protocolVersion = version
+	if share != nil {
+		client.shareID = share.ShareID
+		client.shareTripID = share.TripID
 	}
+	go client.writer()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	_ = setLiveUserStatus(ctx, userID, "online")
-	cancel()
+	if !hub.Register(client) {
+		client.close(websocket.CloseServiceRestart, "server restarting")
+		return
+	}
 
-	log.Printf("User %s connected", userID)
+	client.writeJSON(SocketResponse{
+		Event: "hello",
+		Payload: HelloPayload{
+			ProtocolVersion:    version,
+			MinProtocolVersion: minProtocolVersion,
+			MaxProtocolVersion: maxProtocolVersion,
+		},
+	})
+
+	if client.userID != "" {
+		_ = setLiveUserStatus(ctx, userID, "online")
+	}
+
+	log.Printf("%s connected", client.logID())
 	reader(client)
 }
 
 func reader(c *Client) {
 	defer func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		_ = setLiveUserStatus(ctx, c.userID, "offline")
-		cancel()
+		if c.userID != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			// Write any buffered fix first so it cannot flip the status back.
+			_ = liveLocations.FlushRider(ctx, c.userID)
+			_ = setLiveUserStatus(ctx, c.userID, "offline")
+			cancel()
+		}
 		hub.Leave(c)
-		_ = c.conn.Close()
-		log.Printf("User %s disconnected", c.userID)
+		hub.Unregister(c)
+		c.close(websocket.CloseNormalClosure, "")
+		log.Printf("%s disconnected", c.logID())
 	}()
 
+	// A connection that stops answering pings hits the read deadline, which
+	// ends the loop and runs the cleanup above.
+	c.conn.SetReadLimit(maxMessageSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
 	for {
 		_, raw, err := c.conn.ReadMessage()
 		if err != nil {
@@ -52,174 +108,284 @@ func reader(c *Client) {
 
 		var msg Message
 		if err := json.Unmarshal(raw, &msg); err != nil {
-			c.writeJSON(SocketResponse{Event: "error", Payload: map[string]string{"message": "invalid message"}})
+			if c.allowFrame(Message{}, rateKeyOther) {
+				c.replyError(Message{}, errCodeInvalidMessage, "invalid message")
+			}
 			continue
 		}
-
-		switch msg.Event {
-		case "join_trip":
-			handleJoinTrip(c, msg.Payload)
-		case "location_update":
-			handleLocationUpdate(c, msg.Payload)
-		case "rider_action":
-			handleRiderActionValidation(c, msg.Payload)
-		case "trip_action":
-			handleTripActionValidation(c, msg.Payload)
-		default:
-			c.writeJSON(SocketResponse{Event: "error", Payload: map[string]string{"message": "unknown event"}})
+		if !c.allowFrame(msg, msg.Event) {
+			continue
 		}
-	}
-}
 
-func handleJoinTrip(c *Client, payloadRaw json.RawMessage) {
-	var payload JoinTripPayload
-	if err := json.Unmarshal(payloadRaw, &payload); err != nil || payload.TripID == "" {
-		c.writeJSON(SocketResponse{Event: "error", Payload: map[string]string{"message": "invalid join payload"}})
-		return
+		dispatchEvent(c, msg)
 	}
+}
 
+// handleSubscribe adds a room to the client's subscriptions. join_trip is
+// kept as an alias for clients that only ever follow one trip.
+func handleSubscribe(c *Client, msg Message, payload *JoinTripPayload, replyEvent string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	role := ""
-	if isDriverForTrip(ctx, payload.TripID, c.userID) {
-		role = "driver"
-	} else if isRiderForTrip(ctx, payload.TripID, c.userID) {
-		role = "rider"
-	}
-
-	if role == "" {
-		c.writeJSON(SocketResponse{Event: "error", Payload: map[string]string{"message": "forbidden trip join"}})
+	auth, ok := c.authorizeTrip(ctx, payload.TripID)
+	if !ok || (payload.Role != "" && payload.Role != auth.Role) {
+		c.replyError(msg, errCodeForbidden, "forbidden trip join")
 		return
 	}
 
-	c.role = role
-	hub.JoinRoom(c, payload.TripID)
-	c.writeJSON(SocketResponse{
-		Event: "joined_trip",
-		Payload: map[string]string{
-			"tripId": payload.TripID,
-			"role":   role,
+	role := auth.Role
+	seq, epoch := hub.JoinRoom(c, payload.TripID, auth)
+	roster := []PresenceParticipant{}
+	if role != "spectator" {
+		roster = hub.Roster(payload.TripID)
+	}
+	c.reply(msg, SocketResponse{
+		Event:  replyEvent,
+		TripID: payload.TripID,
+		Payload: SubscribedPayload{
+			TripID:   payload.TripID,
+			Role:     role,
+			Seq:      seq,
+			Epoch:    epoch,
+			Presence: roster,
 		},
 	})
 }
 
-func handleLocationUpdate(c *Client, payloadRaw json.RawMessage) {
-	var payload LocationUpdatePayload
-	if err := json.Unmarshal(payloadRaw, &payload); err != nil || payload.TripID == "" {
-		c.writeJSON(SocketResponse{Event: "error", Payload: map[string]string{"message": "invalid location payload"}})
+func handleUnsubscribe(c *Client, msg Message, payload *UnsubscribePayload) {
+	if !hub.LeaveRoom(c, payload.TripID) {
+		c.replyError(msg, errCodeNotJoined, "not subscribed to trip")
 		return
 	}
+	c.reply(msg, SocketResponse{
+		Event:   "unsubscribed",
+		TripID:  payload.TripID,
+		Payload: UnsubscribedPayload{TripID: payload.TripID},
+	})
+}
 
-	if c.tripID == "" || c.tripID != payload.TripID {
-		c.writeJSON(SocketResponse{Event: "error", Payload: map[string]string{"message": "join trip first"}})
+func handleResume(c *Client, msg Message, payload *ResumePayload) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	auth, ok := c.authorizeTrip(ctx, payload.TripID)
+	if !ok {
+		c.replyError(msg, errCodeForbidden, "forbidden trip join")
 		return
 	}
 
+	role := auth.Role
+	replayed, seq, epoch, ok := hub.Resume(c, payload.TripID, auth, payload.LastSeq, payload.Epoch)
+	event := "resumed"
+	if !ok {
+		event = "resync_required"
+	}
+	c.reply(msg, SocketResponse{
+		Event:  event,
+		TripID: payload.TripID,
+		Payload: ResumeResultPayload{
+			TripID:   payload.TripID,
+			Role:     role,
+			Replayed: replayed,
+			Seq:      seq,
+			Epoch:    epoch,
+		},
+	})
+}
+
+func handleLocationUpdate(c *Client, msg Message, payload *LocationUpdatePayload) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if isDriverForTrip(ctx, payload.TripID, c.userID) {
-		if err := upsertDriverLiveLocation(ctx, payload.TripID, c.userID, payload); err != nil {
-			c.writeJSON(SocketResponse{Event: "error", Payload: map[string]string{"message": "driver location update failed"}})
-			return
-		}
-		hub.BroadcastToTrip(payload.TripID, SocketResponse{
-			Event: "driver_location_updated",
-			Payload: map[string]interface{}{
-				"tripId":     payload.TripID,
-				"lat":        payload.Lat,
-				"lng":        payload.Lng,
-				"heading":    payload.Heading,
-				"speedKmph":  payload.SpeedKmph,
-				"updatedAt":  time.Now().UTC().Format(time.RFC3339),
-				"sourceRole": "driver",
-			},
-		})
+	auth, ok := c.currentAuth(ctx, payload.TripID)
+	if !ok {
+		c.replyError(msg, errCodeForbidden, "forbidden location update")
 		return
 	}
 
-	if isRiderForTrip(ctx, payload.TripID, c.userID) {
-		if err := upsertRiderLiveLocation(ctx, c.userID, payload); err != nil {
-			c.writeJSON(SocketResponse{Event: "error", Payload: map[string]string{"message": "rider location update failed"}})
-			return
-		}
-		riderName := getUserName(ctx, c.userID)
-		requestID := getRequestIDForTripRider(ctx, payload.TripID, c.userID)
-		if requestID == "" {
-			c.writeJSON(SocketResponse{Event: "error", Payload: map[string]string{"message": "active ride request not found"}})
+	now := time.Now()
+	source := auth.Role
+	if auth.Role == "rider" {
+		source = "rider:" + c.userID
+	}
+	filtered, ok := hub.FilterFix(payload.TripID, source, *payload, now)
+	if !ok {
+		c.replyError(msg, errCodeBadPosition, "position jumps further than the vehicle could travel")
+		return
+	}
+
+	switch auth.Role {
+	case "driver":
+		fix := driverFix{tripID: payload.TripID, driverID: auth.DriverID, payload: filtered, receivedAt: now}
+		liveLocations.PutTrace(fix)
+		if err := driverLocations.Submit(fix); err != nil {
+			c.replyError(msg, errCodeUpdateFailed, "driver location update failed")
 			return
 		}
+		c.ack(msg)
+	case "rider":
+		liveLocations.PutRider(riderFix{tripID: payload.TripID, userID: c.userID, payload: filtered, receivedAt: now})
 		hub.BroadcastToTripRole(payload.TripID, "driver", SocketResponse{
 			Event: "rider_location_updated",
-			Payload: map[string]interface{}{
-				"tripId":     payload.TripID,
-				"requestId":  requestID,
-				"riderName":  riderName,
-				"lat":        payload.Lat,
-				"lng":        payload.Lng,
-				"status":     "trip_active",
-				"updatedAt":  time.Now().UTC().Format(time.RFC3339),
-				"sourceRole": "rider",
+			Payload: RiderLocationPayload{
+				TripID:     payload.TripID,
+				RequestID:  auth.RequestID,
+				RiderName:  auth.Name,
+				Lat:        filtered.Lat,
+				Lng:        filtered.Lng,
+				Status:     "trip_active",
+				UpdatedAt:  now.UTC().Format(time.RFC3339),
+				SourceRole: "rider",
 			},
 		})
-		return
+		c.ack(msg)
+	default:
+		c.replyError(msg, errCodeForbidden, "forbidden location update")
 	}
+}
 
-	c.writeJSON(SocketResponse{Event: "error", Payload: map[string]string{"message": "forbidden location update"}})
+// flushDriverFix hands a coalesced driver fix to the write-behind buffer,
+// fans it out to the room and queues the route and geofence checks.
+func flushDriverFix(fix driverFix) error {
+	liveLocations.PutDriver(fix)
+
+	hub.BroadcastToTrip(fix.tripID, SocketResponse{
+		Event: "driver_location_updated",
+		Payload: DriverLocationPayload{
+			TripID:     fix.tripID,
+			Lat:        fix.payload.Lat,
+			Lng:        fix.payload.Lng,
+			Heading:    fix.payload.Heading,
+			SpeedKmph:  fix.payload.SpeedKmph,
+			UpdatedAt:  fix.receivedAt.UTC().Format(time.RFC3339),
+			SourceRole: "driver",
+		},
+	})
+
+	driverFixChecks.Submit(fix)
+	return nil
 }
 
-func handleRiderActionValidation(c *Client, payloadRaw json.RawMessage) {
-	var payload RiderActionPayload
-	if err := json.Unmarshal(payloadRaw, &payload); err != nil || payload.TripID == "" || payload.RequestID == "" {
-		c.writeJSON(SocketResponse{Event: "error", Payload: map[string]string{"message": "invalid rider action payload"}})
-		return
+// checkDriverFix places a driver fix on the planned route, sending the
+// progress to the room, and checks it against the trip's geofences.
+func checkDriverFix(fix driverFix) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if route := routeMonitors.Evaluate(ctx, fix); route != nil {
+		route.TripID = fix.tripID
+		route.At = fix.receivedAt.UTC().Format(time.RFC3339)
+		hub.BroadcastToTrip(fix.tripID, SocketResponse{Event: "route_progress", Payload: route})
 	}
+	geofences.Evaluate(ctx, fix)
+}
 
+// forgetDriverFixChecks drops the route and geofence state of an ended trip.
+func forgetDriverFixChecks(tripID string) {
+	geofences.Forget(tripID)
+	routeMonitors.Forget(tripID)
+}
+
+func handleRiderActionValidation(c *Client, msg Message, payload *RiderActionPayload) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if !isRiderForTrip(ctx, payload.TripID, c.userID) {
-		c.writeJSON(SocketResponse{Event: "rider_action_validation", Payload: map[string]interface{}{"allowed": false, "reason": "rider only"}})
+		c.reply(msg, SocketResponse{
+			Event: "rider_action_validation",
+			Payload: RiderActionValidationPayload{
+				TripID:    payload.TripID,
+				RequestID: payload.RequestID,
+				Action:    payload.Action,
+				Allowed:   false,
+				Reason:    "rider only",
+			},
+		})
 		return
 	}
 
 	allowed, reason := validateRiderDistanceForSelfAction(ctx, payload.TripID, payload.RequestID, c.userID, payload.Action)
-	c.writeJSON(SocketResponse{
+	c.reply(msg, SocketResponse{
 		Event: "rider_action_validation",
-		Payload: map[string]interface{}{
-			"tripId":    payload.TripID,
-			"requestId": payload.RequestID,
-			"action":    payload.Action,
-			"allowed":   allowed,
-			"reason":    reason,
+		Payload: RiderActionValidationPayload{
+			TripID:    payload.TripID,
+			RequestID: payload.RequestID,
+			Action:    payload.Action,
+			Allowed:   allowed,
+			Reason:    reason,
 		},
 	})
 }
 
-func handleTripActionValidation(c *Client, payloadRaw json.RawMessage) {
-	var payload TripActionPayload
-	if err := json.Unmarshal(payloadRaw, &payload); err != nil || payload.TripID == "" {
-		c.writeJSON(SocketResponse{Event: "error", Payload: map[string]string{"message": "invalid trip action payload"}})
+func handleSOS(c *Client, msg Message, payload *SOSPayload) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	auth, ok := c.currentAuth(ctx, payload.TripID)
+	if !ok {
+		c.replyError(msg, errCodeForbidden, "not a participant of this trip")
+		return
+	}
+	if _, err := raiseSOS(ctx, payload.TripID, c.userID, auth.Role, payload.Note, payload.Lat, payload.Lng); err != nil {
+		log.Printf("%s SOS failed for trip %s: %v", c.logID(), payload.TripID, err)
+		c.replyError(msg, errCodeUpdateFailed, "failed to raise SOS")
+		return
+	}
+	c.ack(msg)
+}
+
+func handleChatMessage(c *Client, msg Message, payload *ChatSendPayload) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	auth, ok := c.currentAuth(ctx, payload.TripID)
+	if !ok {
+		c.replyError(msg, errCodeForbidden, "not a participant of this trip")
+		return
+	}
+	if payload.Scope == "direct" && auth.Role == "driver" && payload.RecipientID == "" {
+		c.replyError(msg, errCodeInvalidPayload, "recipientId is required for direct messages")
 		return
 	}
 
+	message, err := insertTripMessage(ctx, payload.TripID, c.userID, payload.Scope, payload.RecipientID, payload.Body)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			c.replyError(msg, errCodeForbidden, "chat is closed or recipient is not on this trip")
+			return
+		}
+		log.Printf("%s chat insert failed for trip %s: %v", c.logID(), payload.TripID, err)
+		c.replyError(msg, errCodeUpdateFailed, "failed to send message")
+		return
+	}
+	message.SenderName = auth.Name
+	message.SenderRole = auth.Role
+
+	out := SocketResponse{Event: "chat_message", Payload: message}
+	if message.RecipientID == "" {
+		hub.BroadcastToTrip(payload.TripID, out)
+	} else {
+		hub.SendToTripUsers(payload.TripID, []string{c.userID, message.RecipientID}, out)
+	}
+	c.ack(msg)
+}
+
+func handleTripActionValidation(c *Client, msg Message, payload *TripActionPayload) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	allowed := isDriverForTrip(ctx, payload.TripID, c.userID)
-	c.writeJSON(SocketResponse{
+	reason := ""
+	if !allowed {
+		reason = "driver only"
+	}
+	c.reply(msg, SocketResponse{
 		Event: "trip_action_validation",
-		Payload: map[string]interface{}{
-			"tripId":  payload.TripID,
-			"action":  payload.Action,
-			"allowed": allowed,
-			"reason": func() string {
-				if allowed {
-					return ""
-				}
-				return "driver only"
-			}(),
+		Payload: TripActionValidationPayload{
+			TripID:  payload.TripID,
+			Action:  payload.Action,
+			Allowed: allowed,
+			Reason:  reason,
 		},
 	})
 }
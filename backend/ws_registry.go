@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Inbound events are declared once with a typed payload, the roles allowed
+// to send them and the protocol version that introduced them. The reader
+// decodes, validates and authorizes through the registry before a handler
+// runs, and the same declarations feed the catalogue served to clients.
+
+const (
+	minProtocolVersion = 1
+	maxProtocolVersion = 2
+)
+
+type eventMeta struct {
+	Summary    string
+	MinVersion int
+	// Roles, when set, requires the sender to hold one of them in the room
+	// named by the payload's tripId.
+	Roles   []string
+	Replies []string
+}
+
+type inboundEvent struct {
+	name     string
+	meta     eventMeta
+	payload  reflect.Type
+	dispatch func(c *Client, msg Message)
+}
+
+type outboundEvent struct {
+	name    string
+	summary string
+	payload reflect.Type
+}
+
+type payloadValidator interface {
+	validate() error
+}
+
+type roomScoped interface {
+	roomID() string
+}
+
+var (
+	inboundEvents  = map[string]*inboundEvent{}
+	outboundEvents = map[string]*outboundEvent{}
+)
+
+func onEvent[P any](name string, meta eventMeta, handle func(c *Client, msg Message, payload *P)) {
+	if meta.MinVersion == 0 {
+		meta.MinVersion = minProtocolVersion
+	}
+	ev := &inboundEvent{name: name, meta: meta, payload: reflect.TypeFor[P]()}
+	ev.dispatch = func(c *Client, msg Message) {
+		var payload P
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			c.replyError(msg, errCodeInvalidPayload, "malformed "+name+" payload")
+			return
+		}
+		if v, ok := any(&payload).(payloadValidator); ok {
+			if err := v.validate(); err != nil {
+				c.replyError(msg, errCodeInvalidPayload, err.Error())
+				return
+			}
+		}
+		if len(meta.Roles) > 0 {
+			scoped, ok := any(&payload).(roomScoped)
+			if !ok {
+				c.replyError(msg, errCodeForbidden, "event is not trip scoped")
+				return
+			}
+			role, joined := hub.RoleIn(c, scoped.roomID())
+			if !joined {
+				c.replyError(msg, errCodeNotJoined, "join trip first")
+				return
+			}
+			if !containsString(meta.Roles, role) {
+				c.replyError(msg, errCodeForbidden, "forbidden for role "+role)
+				return
+			}
+		}
+		handle(c, msg, &payload)
+	}
+	inboundEvents[name] = ev
+}
+
+func emits[P any](name, summary string) {
+	outboundEvents[name] = &outboundEvent{name: name, summary: summary, payload: reflect.TypeFor[P]()}
+}
+
+func dispatchEvent(c *Client, msg Message) {
+	ev, ok := inboundEvents[msg.Event]
+	if !ok {
+		c.replyError(msg, errCodeUnknownEvent, "unknown event")
+		return
+	}
+	if c.protocolVersion < ev.meta.MinVersion {
+		c.replyError(msg, errCodeUnsupportedVersion, "event requires a newer protocol version")
+		return
+	}
+	ev.dispatch(c, msg)
+}
+
+// negotiateProtocolVersion picks the version for a connection from the ?v=
+// query value. Clients that send nothing get version 1; newer clients are
+// capped at the highest version this server speaks.
+func negotiateProtocolVersion(raw string) (int, bool) {
+	if raw == "" {
+		return minProtocolVersion, true
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < minProtocolVersion {
+		return 0, false
+	}
+	if v > maxProtocolVersion {
+		v = maxProtocolVersion
+	}
+	return v, true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// wsCatalog describes the socket protocol as an AsyncAPI 2.6 document.
+// "publish" lists what clients send and "subscribe" what they receive.
+func wsCatalog() map[string]interface{} {
+	messages := map[string]interface{}{}
+	var publish, subscribe []interface{}
+
+	for _, name := range sortedKeys(inboundEvents) {
+		ev := inboundEvents[name]
+		key := "in." + name
+		msg := map[string]interface{}{
+			"name":          name,
+			"summary":       ev.meta.Summary,
+			"payload":       envelopeSchema(name, ev.payload, true),
+			"x-min-version": ev.meta.MinVersion,
+		}
+		if len(ev.meta.Roles) > 0 {
+			msg["x-roles"] = ev.meta.Roles
+		}
+		if len(ev.meta.Replies) > 0 {
+			msg["x-replies"] = ev.meta.Replies
+		}
+		messages[key] = msg
+		publish = append(publish, map[string]string{"$ref": "#/components/messages/" + key})
+	}
+
+	for _, name := range sortedKeys(outboundEvents) {
+		ev := outboundEvents[name]
+		key := "out." + name
+		messages[key] = map[string]interface{}{
+			"name":    name,
+			"summary": ev.summary,
+			"payload": envelopeSchema(name, ev.payload, false),
+		}
+		subscribe = append(subscribe, map[string]string{"$ref": "#/components/messages/" + key})
+	}
+
+	return map[string]interface{}{
+		"asyncapi": "2.6.0",
+		"info": map[string]interface{}{
+			"title":   "YatraSathi realtime API",
+			"version": maxProtocolVersion,
+			"x-protocol-versions": map[string]int{
+				"min": minProtocolVersion,
+				"max": maxProtocolVersion,
+			},
+		},
+		"channels": map[string]interface{}{
+			"/ws": map[string]interface{}{
+				"publish":   map[string]interface{}{"message": map[string]interface{}{"oneOf": publish}},
+				"subscribe": map[string]interface{}{"message": map[string]interface{}{"oneOf": subscribe}},
+			},
+		},
+		"components": map[string]interface{}{"messages": messages},
+	}
+}
+
+func envelopeSchema(event string, payload reflect.Type, inbound bool) map[string]interface{} {
+	props := map[string]interface{}{
+		"id":      map[string]interface{}{"type": "string"},
+		"event":   map[string]interface{}{"type": "string", "const": event},
+		"payload": jsonSchemaFor(payload),
+	}
+	if !inbound {
+		props["tripId"] = map[string]interface{}{"type": "string"}
+		props["seq"] = map[string]interface{}{"type": "integer", "minimum": 0}
+		props["replay"] = map[string]interface{}{"type": "boolean"}
+	}
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+		"required":   []string{"event", "payload"},
+	}
+}
+
+var rawMessageType = reflect.TypeFor[json.RawMessage]()
+
+func jsonSchemaFor(t reflect.Type) map[string]interface{} {
+	if t == rawMessageType {
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := jsonSchemaFor(t.Elem())
+		if typ, ok := schema["type"].(string); ok {
+			schema["type"] = []string{typ, "null"}
+		}
+		return schema
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchemaFor(t.Elem())}
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = jsonSchemaFor(f.Type)
+			if opts != "omitempty" && f.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]interface{}{"type": "object", "properties": props}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -33,6 +33,10 @@ export interface Driver {
 }
 
 
+// fixed: riders pay the fare quoted at booking. distance: the quote is
+// prorated by the distance actually travelled onboard at dropoff.
+export type PricingMode = 'fixed' | 'distance';
+
 export interface Trip {
     id: string;
     driver_id: string;
@@ -46,6 +50,7 @@ export interface Trip {
     total_seats: number;
     available_seats: number;
     description: string | null;
+    pricing_mode: PricingMode;
     status: TripStatus;
     cancelled_at: Date | null;
     cancelled_reason: string | null;
@@ -72,6 +77,8 @@ export interface RideRequest {
     drop_address: string;
     seats: number;
     total_fare: number;
+    final_fare: number | null;
+    onboard_distance_m: number | null;
     status: RideRequestStatus;
     cancelled_at: Date | null;
     cancelled_reason: string | null;
@@ -260,6 +267,7 @@ export const createTrip = async (data: {
     route?: string | null;
     route_id?: string | null;
     description?: string | null;
+    pricing_mode?: PricingMode;
     stops?: { location: string; address: string; order: number }[];
 }): Promise<Trip | undefined> => {
     const client = await pool.connect();
@@ -294,16 +302,16 @@ export const createTrip = async (data: {
         const tripSql = `
             INSERT INTO trips (
                 driver_id, from_location, from_address, to_location, to_address,
-                travel_date, fare_per_seat, total_seats, available_seats, route_id, description
+                travel_date, fare_per_seat, total_seats, available_seats, route_id, description, pricing_mode
             )
-            VALUES ($1, ST_GeogFromText($2), $3, ST_GeogFromText($4), $5, $6, $7, $8, $8, $9, $10)
+            VALUES ($1, ST_GeogFromText($2), $3, ST_GeogFromText($4), $5, $6, $7, $8, $8, $9, $10, $11)
             RETURNING 
                 id, driver_id, 
                 ST_AsText(from_location) as from_location, from_address,
                 ST_AsText(to_location) as to_location, to_address,
                 route_id,
                 travel_date, fare_per_seat, total_seats, available_seats,
-                description, status, cancelled_at, cancelled_reason,
+                description, pricing_mode, status, cancelled_at, cancelled_reason,
                 created_at, updated_at;
         `;
 
@@ -317,7 +325,8 @@ export const createTrip = async (data: {
             data.fare_per_seat,
             data.total_seats,
             routeId ?? null,
-            data.description ?? null
+            data.description ?? null,
+            data.pricing_mode ?? 'fixed'
         ]);
 
         const trip = tripRes.rows[0];
@@ -95,9 +95,15 @@ export const initDb = async () => {
                 stop_location GEOGRAPHY(POINT, 4326) NOT NULL,
                 stop_address TEXT NOT NULL,
                 stop_order INT NOT NULL,
+                arrived_at TIMESTAMPTZ,
+                departed_at TIMESTAMPTZ,
+                skipped_at TIMESTAMPTZ,
                 created_at TIMESTAMPTZ DEFAULT now()
             );
             CREATE INDEX IF NOT EXISTS idx_trip_stops_trip_id ON trip_stops(trip_id);
+            ALTER TABLE trip_stops ADD COLUMN IF NOT EXISTS arrived_at TIMESTAMPTZ;
+            ALTER TABLE trip_stops ADD COLUMN IF NOT EXISTS departed_at TIMESTAMPTZ;
+            ALTER TABLE trip_stops ADD COLUMN IF NOT EXISTS skipped_at TIMESTAMPTZ;
 
             -- 5. RIDE REQUESTS
             CREATE TABLE IF NOT EXISTS ride_requests (
@@ -146,6 +152,8 @@ export const initDb = async () => {
                 last_updated TIMESTAMPTZ DEFAULT now()
             );
             CREATE INDEX IF NOT EXISTS idx_live_trips_location ON live_trips USING GIST(current_location);
+            ALTER TABLE trips ADD COLUMN IF NOT EXISTS started_at TIMESTAMPTZ;
+            ALTER TABLE trips ADD COLUMN IF NOT EXISTS signal_lost_at TIMESTAMPTZ;
 
             -- 7. LIVE USERS
             CREATE TABLE IF NOT EXISTS live_users (
@@ -155,6 +163,89 @@ export const initDb = async () => {
                 last_updated TIMESTAMPTZ DEFAULT now()
             );
 
+            -- 7.1 HUB MESSAGES (room messages too large for NOTIFY; peers fetch them by id)
+            CREATE TABLE IF NOT EXISTS hub_messages (
+                id BIGSERIAL PRIMARY KEY,
+                body TEXT NOT NULL,
+                created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+            );
+            CREATE INDEX IF NOT EXISTS idx_hub_messages_created ON hub_messages(created_at);
+
+            -- 8. TRIP SHARE LINKS
+            CREATE TABLE IF NOT EXISTS trip_share_links (
+                id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+                trip_id UUID NOT NULL REFERENCES trips(id) ON DELETE CASCADE,
+                created_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                expires_at TIMESTAMPTZ NOT NULL,
+                revoked_at TIMESTAMPTZ,
+                created_at TIMESTAMPTZ DEFAULT now()
+            );
+            CREATE INDEX IF NOT EXISTS idx_trip_share_links_trip_id ON trip_share_links(trip_id);
+
+            -- 9. TRIP CHAT
+            CREATE TABLE IF NOT EXISTS trip_messages (
+                id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+                trip_id UUID NOT NULL REFERENCES trips(id) ON DELETE CASCADE,
+                sender_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                recipient_id UUID REFERENCES users(id) ON DELETE CASCADE,
+                body TEXT NOT NULL,
+                created_at TIMESTAMPTZ DEFAULT now()
+            );
+            CREATE INDEX IF NOT EXISTS idx_trip_messages_trip_created ON trip_messages(trip_id, created_at DESC);
+            CREATE INDEX IF NOT EXISTS idx_trip_messages_created ON trip_messages(created_at);
+
+            -- 10. INCIDENTS (SOS)
+            CREATE TABLE IF NOT EXISTS incidents (
+                id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+                trip_id UUID NOT NULL REFERENCES trips(id) ON DELETE CASCADE,
+                raised_by UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+                raised_by_role TEXT NOT NULL CHECK (raised_by_role IN ('driver', 'rider')),
+                location GEOGRAPHY(POINT, 4326),
+                location_source TEXT,
+                location_recorded_at TIMESTAMPTZ,
+                note TEXT,
+                details JSONB NOT NULL,
+                status TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'acknowledged')),
+                escalation_level INT NOT NULL DEFAULT 0,
+                last_notified_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                acknowledged_by TEXT,
+                acknowledged_at TIMESTAMPTZ,
+                created_at TIMESTAMPTZ DEFAULT now()
+            );
+            CREATE INDEX IF NOT EXISTS idx_incidents_trip_id ON incidents(trip_id);
+            CREATE INDEX IF NOT EXISTS idx_incidents_open ON incidents(last_notified_at) WHERE status = 'open';
+            CREATE UNIQUE INDEX IF NOT EXISTS idx_incidents_one_open ON incidents(trip_id, raised_by) WHERE status = 'open';
+
+            -- 11. TRIP TRACE (GPS breadcrumbs, partitioned by month; the backend creates
+            -- monthly partitions ahead of time and the default catches anything else)
+            CREATE TABLE IF NOT EXISTS trip_trace (
+                trip_id UUID NOT NULL REFERENCES trips(id) ON DELETE CASCADE,
+                recorded_at TIMESTAMPTZ NOT NULL,
+                location GEOGRAPHY(POINT, 4326) NOT NULL,
+                heading NUMERIC(5, 2),
+                speed_kmph NUMERIC(5, 2)
+            ) PARTITION BY RANGE (recorded_at);
+            CREATE TABLE IF NOT EXISTS trip_trace_default PARTITION OF trip_trace DEFAULT;
+            CREATE INDEX IF NOT EXISTS idx_trip_trace_trip_time ON trip_trace(trip_id, recorded_at);
+            ALTER TABLE trips ADD COLUMN IF NOT EXISTS driven_path GEOGRAPHY(LineString, 4326);
+            ALTER TABLE trips ADD COLUMN IF NOT EXISTS driven_distance_m NUMERIC(10, 1);
+
+            -- 12. TRIP EVENTS (lifecycle timeline for replay)
+            CREATE TABLE IF NOT EXISTS trip_events (
+                id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+                trip_id UUID NOT NULL REFERENCES trips(id) ON DELETE CASCADE,
+                event TEXT NOT NULL,
+                request_id UUID REFERENCES ride_requests(id) ON DELETE CASCADE,
+                occurred_at TIMESTAMPTZ NOT NULL DEFAULT now()
+            );
+            CREATE INDEX IF NOT EXISTS idx_trip_events_trip_time ON trip_events(trip_id, occurred_at);
+
+            -- 13. FARE PRORATION (trips.pricing_mode: fixed or distance)
+            ALTER TABLE trips ADD COLUMN IF NOT EXISTS pricing_mode TEXT NOT NULL DEFAULT 'fixed' CHECK (pricing_mode IN ('fixed', 'distance'));
+            ALTER TABLE ride_requests ADD COLUMN IF NOT EXISTS final_fare NUMERIC(10, 2);
+            ALTER TABLE ride_requests ADD COLUMN IF NOT EXISTS onboard_distance_m NUMERIC(10, 1);
+            CREATE INDEX IF NOT EXISTS idx_trip_events_request ON trip_events(request_id);
+
             -- TRIGGERS
             CREATE OR REPLACE FUNCTION update_updated_at_column()
             RETURNS TRIGGER AS $$